@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The roles an API key can have. Librarians may do anything; patrons may read the catalog and manage their own loans, holds and account.
+const (
+	roleLibrarian = "librarian"
+	rolePatron    = "patron"
+)
+
+// principalKey is the gin context key under which authenticate stores the caller.
+const principalKey = "principal"
+
+// A principal is the caller an API key belongs to. PatronID is set for patrons only, and PatronType picks
+// the rules of the borrowing policy that apply to them.
+type principal struct {
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	PatronID   string `json:"patron_id,omitempty"`
+	PatronType string `json:"patron_type,omitempty"`
+}
+
+// An apiKey is one entry of the keys file: the secret key and who it belongs to.
+type apiKey struct {
+	Key string `json:"key"`
+	principal
+}
+
+// apiKeys maps the hex SHA-256 of each key to its principal, so the keys themselves are not kept in memory.
+// It is loaded in main from the file given with -api-keys. A nil map turns authentication off.
+var apiKeys map[string]principal
+
+// loadAPIKeys reads a JSON array of apiKey from a file.
+func loadAPIKeys(path string) (map[string]principal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []apiKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	keys := map[string]principal{}
+	for _, k := range list {
+		switch {
+		case k.Key == "":
+			return nil, errors.New("every API key needs a key")
+		case k.Role != roleLibrarian && k.Role != rolePatron:
+			return nil, errors.New("API key " + k.Name + " has unknown role " + k.Role)
+		case k.Role == rolePatron && k.PatronID == "":
+			return nil, errors.New("patron API key " + k.Name + " needs a patron_id")
+		}
+		keys[hashKey(k.Key)] = k.principal
+	}
+	return keys, nil
+}
+
+// hashKey returns the hex SHA-256 of an API key.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate is Gin middleware that identifies the caller from the "Authorization: Bearer <key>" or "X-API-Key" header.
+// Requests without a known key are rejected with a 401 Unauthorized status code.
+// When authentication is turned off every caller is treated as a librarian.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKeys == nil {
+			c.Set(principalKey, principal{Name: "anonymous", Role: roleLibrarian})
+			return
+		}
+		key := c.GetHeader("X-API-Key")
+		if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+		p, ok := apiKeys[hashKey(key)]
+		if key == "" || !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="library"`)
+			c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "A valid API key is required."})
+			c.Abort()
+			return
+		}
+		c.Set(principalKey, p)
+	}
+}
+
+// caller returns the principal stored by authenticate.
+func caller(c *gin.Context) principal {
+	p, _ := c.Get(principalKey)
+	return p.(principal)
+}
+
+// requireLibrarian is Gin middleware that only lets librarians through, answering 403 Forbidden to everyone else.
+func requireLibrarian() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if caller(c).Role != roleLibrarian {
+			c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Only librarians may do this."})
+			c.Abort()
+		}
+	}
+}
+
+// requireSelf is Gin middleware for /patrons/:id routes. Patrons may only reach their own records; librarians may reach anyone's.
+func requireSelf() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowedPatron(c, c.Param("id")) {
+			c.Abort()
+		}
+	}
+}
+
+// allowedPatron reports whether the caller may act for the given patron. If not, it writes a 403 Forbidden response.
+func allowedPatron(c *gin.Context, patronID string) bool {
+	if mayActFor(caller(c), patronID) {
+		return true
+	}
+	respondNotYourPatron(c)
+	return false
+}
+
+// errNotYourPatron is returned when a patron tries to act on another patron's loans or holds.
+var errNotYourPatron = errors.New("patrons may only act on their own loans and holds")
+
+// mayActFor reports whether p may act on the loans and holds of patronID: librarians for anyone, patrons only for themselves.
+func mayActFor(p principal, patronID string) bool {
+	return p.Role == roleLibrarian || p.PatronID == patronID
+}
+
+// respondNotYourPatron writes the 403 Forbidden response for errNotYourPatron.
+func respondNotYourPatron(c *gin.Context) {
+	c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Patrons may only act on their own loans and holds."})
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// errKeyNotFound is returned by the bolt helpers when a key is missing from its bucket.
+var errKeyNotFound = errors.New("key not found")
+
+// openBoltDB opens (or creates) the bbolt database file at path.
+func openBoltDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// Records are stored as JSON values in one bucket per record type, keyed by the record ID.
+// The helpers below are shared by every bolt-backed store.
+
+// boltGet decodes the value stored under key with decode, or returns errKeyNotFound.
+func boltGet(tx *bolt.Tx, bucket, key string, decode func(data []byte) (interface{}, error)) (interface{}, error) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, errKeyNotFound
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return nil, errKeyNotFound
+	}
+	return decode(data)
+}
+
+// boltPut encodes v as JSON and stores it under key, creating the bucket if needed.
+func boltPut(tx *bolt.Tx, bucket, key string, v interface{}) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// A boltBucket holds one type of record, and does the reads and writes every bolt store shares. Records are written
+// as JSON by boltPut and read back by decode, which returns them as the store's own type for the store to assert.
+type boltBucket struct {
+	db   *bolt.DB
+	name string
+	// decode turns a stored value back into a record.
+	decode func(data []byte) (interface{}, error)
+	// notFound is returned for a key with no record.
+	notFound error
+	// exists is returned by create for a key that already has a record. If nil, create overwrites it.
+	exists error
+}
+
+// list returns every record, in key order.
+func (b boltBucket) list() ([]interface{}, error) {
+	list := []interface{}{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(b.name))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			v, err := b.decode(data)
+			if err != nil {
+				return err
+			}
+			list = append(list, v)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// get returns the record stored under key, or notFound.
+func (b boltBucket) get(key string) (interface{}, error) {
+	var v interface{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = boltGet(tx, b.name, key, b.decode)
+		return err
+	})
+	if errors.Is(err, errKeyNotFound) {
+		return nil, b.notFound
+	}
+	return v, err
+}
+
+// create stores v under key, or returns exists if the key is taken and exists is set.
+func (b boltBucket) create(key string, v interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if b.exists != nil {
+			if bucket := tx.Bucket([]byte(b.name)); bucket != nil && bucket.Get([]byte(key)) != nil {
+				return b.exists
+			}
+		}
+		return boltPut(tx, b.name, key, v)
+	})
+}
+
+// modify passes the record stored under key to fn and, in the same transaction, stores the record fn returns,
+// or deletes it if fn returns nil. Bolt allows a single writer at a time, so no other write can slip in between.
+// It returns notFound if there is no record.
+func (b boltBucket) modify(key string, fn func(current interface{}) (interface{}, error)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		current, err := boltGet(tx, b.name, key, b.decode)
+		if errors.Is(err, errKeyNotFound) {
+			return b.notFound
+		} else if err != nil {
+			return err
+		}
+		next, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return tx.Bucket([]byte(b.name)).Delete([]byte(key))
+		}
+		return boltPut(tx, b.name, key, next)
+	})
+}
+
+// update overwrites the record stored under key, or returns notFound.
+func (b boltBucket) update(key string, v interface{}) error {
+	return b.modify(key, func(interface{}) (interface{}, error) {
+		return v, nil
+	})
+}
+
+// delete removes the record stored under key, or returns notFound.
+func (b boltBucket) delete(key string) error {
+	return b.modify(key, func(interface{}) (interface{}, error) {
+		return nil, nil
+	})
+}
+
+// remove removes the record stored under key, if there is one.
+func (b boltBucket) remove(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(b.name)); bucket != nil {
+			return bucket.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// booksBucket is the bolt bucket holding the catalog.
+const booksBucket = "books"
+
+// boltBookStore keeps the catalog in a bbolt database file so it survives restarts.
+type boltBookStore struct {
+	boltBucket
+}
+
+// newBoltBookStore returns a store backed by db. If the catalog is empty it is seeded with the given books,
+// which are also returned so the caller can log them; seeded is empty if the catalog already had books.
+func newBoltBookStore(db *bolt.DB, initial []book) (s *boltBookStore, seeded []book, err error) {
+	s = &boltBookStore{boltBucket{
+		db:   db,
+		name: booksBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v book
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errBookNotFound,
+		exists:   errBookExists,
+	}}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(booksBucket)); b != nil && b.Stats().KeyN > 0 {
+			return nil
+		}
+		for _, b := range initial {
+			if err := boltPut(tx, booksBucket, b.ID, b); err != nil {
+				return err
+			}
+		}
+		seeded = initial
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, seeded, nil
+}
+
+func (s *boltBookStore) List() ([]book, error) {
+	values, err := s.list()
+	books := make([]book, 0, len(values))
+	for _, v := range values {
+		books = append(books, v.(book))
+	}
+	return books, err
+}
+
+func (s *boltBookStore) Get(id string) (book, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return book{}, err
+	}
+	return v.(book), nil
+}
+
+func (s *boltBookStore) Create(b book) (book, error) {
+	b.Version = 1
+	if err := s.create(b.ID, b); err != nil {
+		return book{}, err
+	}
+	return b, nil
+}
+
+func (s *boltBookStore) Update(b book) (book, error) {
+	err := s.modify(b.ID, func(current interface{}) (interface{}, error) {
+		if current.(book).Version != b.Version {
+			return nil, errVersionConflict
+		}
+		b.Version++
+		return b, nil
+	})
+	if err != nil {
+		return book{}, err
+	}
+	return b, nil
+}
+
+func (s *boltBookStore) Delete(id string, version int) error {
+	return s.modify(id, func(current interface{}) (interface{}, error) {
+		if current.(book).Version != version {
+			return nil, errVersionConflict
+		}
+		return nil, nil
+	})
+}
+
+// loansBucket is the bolt bucket holding loans.
+const loansBucket = "loans"
+
+// boltLoanStore keeps loans in the same bbolt database file as the catalog.
+type boltLoanStore struct {
+	boltBucket
+}
+
+func newBoltLoanStore(db *bolt.DB) *boltLoanStore {
+	return &boltLoanStore{boltBucket{
+		db:   db,
+		name: loansBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v loan
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errLoanNotFound,
+	}}
+}
+
+func (s *boltLoanStore) List() ([]loan, error) {
+	values, err := s.list()
+	list := make([]loan, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(loan))
+	}
+	sortLoans(list)
+	return list, err
+}
+
+func (s *boltLoanStore) Get(id string) (loan, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return loan{}, err
+	}
+	return v.(loan), nil
+}
+
+func (s *boltLoanStore) Create(l loan) error {
+	return s.create(l.ID, l)
+}
+
+func (s *boltLoanStore) Update(l loan) error {
+	return s.update(l.ID, l)
+}
+
+func (s *boltLoanStore) Delete(id string) error {
+	return s.remove(id)
+}
+
+// holdsBucket is the bolt bucket holding holds.
+const holdsBucket = "holds"
+
+// boltHoldStore keeps holds in the same bbolt database file as the catalog.
+type boltHoldStore struct {
+	boltBucket
+}
+
+func newBoltHoldStore(db *bolt.DB) *boltHoldStore {
+	return &boltHoldStore{boltBucket{
+		db:   db,
+		name: holdsBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v hold
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errHoldNotFound,
+	}}
+}
+
+func (s *boltHoldStore) List() ([]hold, error) {
+	values, err := s.list()
+	list := make([]hold, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(hold))
+	}
+	sortHolds(list)
+	return list, err
+}
+
+func (s *boltHoldStore) Get(id string) (hold, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return hold{}, err
+	}
+	return v.(hold), nil
+}
+
+func (s *boltHoldStore) Create(h hold) error {
+	return s.create(h.ID, h)
+}
+
+func (s *boltHoldStore) Update(h hold) error {
+	return s.update(h.ID, h)
+}
+
+// itemsBucket is the bolt bucket holding copies, keyed by barcode.
+const itemsBucket = "items"
+
+// boltItemStore keeps copies in the same bbolt database file as the catalog.
+type boltItemStore struct {
+	boltBucket
+}
+
+func newBoltItemStore(db *bolt.DB) *boltItemStore {
+	return &boltItemStore{boltBucket{
+		db:   db,
+		name: itemsBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v item
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errItemNotFound,
+		exists:   errItemExists,
+	}}
+}
+
+func (s *boltItemStore) List() ([]item, error) {
+	values, err := s.list()
+	list := make([]item, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(item))
+	}
+	sortItems(list)
+	return list, err
+}
+
+func (s *boltItemStore) Get(barcode string) (item, error) {
+	v, err := s.get(barcode)
+	if err != nil {
+		return item{}, err
+	}
+	return v.(item), nil
+}
+
+func (s *boltItemStore) Create(it item) error {
+	return s.create(it.Barcode, it)
+}
+
+func (s *boltItemStore) Update(it item) error {
+	return s.update(it.Barcode, it)
+}
+
+func (s *boltItemStore) Delete(barcode string) error {
+	return s.delete(barcode)
+}
+
+// ledgerBucket is the bolt bucket holding fines, payments and waivers.
+const ledgerBucket = "ledger"
+
+// boltLedgerStore keeps the ledger in the same bbolt database file as the catalog.
+type boltLedgerStore struct {
+	boltBucket
+}
+
+func newBoltLedgerStore(db *bolt.DB) *boltLedgerStore {
+	return &boltLedgerStore{boltBucket{
+		db:   db,
+		name: ledgerBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v ledgerEntry
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errKeyNotFound,
+	}}
+}
+
+func (s *boltLedgerStore) List() ([]ledgerEntry, error) {
+	values, err := s.list()
+	list := make([]ledgerEntry, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(ledgerEntry))
+	}
+	sortLedger(list)
+	return list, err
+}
+
+func (s *boltLedgerStore) Create(e ledgerEntry) error {
+	return s.create(e.ID, e)
+}
+
+func (s *boltLedgerStore) Delete(id string) error {
+	return s.remove(id)
+}
+
+// webhooksBucket and deliveriesBucket are the bolt buckets holding webhook subscriptions and their deliveries.
+const (
+	webhooksBucket   = "webhooks"
+	deliveriesBucket = "deliveries"
+)
+
+// boltWebhookStore keeps webhooks in the same bbolt database file as the catalog.
+type boltWebhookStore struct {
+	boltBucket
+}
+
+func newBoltWebhookStore(db *bolt.DB) *boltWebhookStore {
+	return &boltWebhookStore{boltBucket{
+		db:   db,
+		name: webhooksBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v webhook
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errWebhookNotFound,
+	}}
+}
+
+func (s *boltWebhookStore) List() ([]webhook, error) {
+	values, err := s.list()
+	list := make([]webhook, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(webhook))
+	}
+	sortWebhooks(list)
+	return list, err
+}
+
+func (s *boltWebhookStore) Get(id string) (webhook, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return webhook{}, err
+	}
+	return v.(webhook), nil
+}
+
+func (s *boltWebhookStore) Create(w webhook) error {
+	return s.create(w.ID, w)
+}
+
+func (s *boltWebhookStore) Delete(id string) error {
+	return s.delete(id)
+}
+
+// boltDeliveryStore keeps webhook deliveries in the same bbolt database file as the catalog,
+// so pending ones are retried after a restart.
+type boltDeliveryStore struct {
+	boltBucket
+}
+
+func newBoltDeliveryStore(db *bolt.DB) *boltDeliveryStore {
+	return &boltDeliveryStore{boltBucket{
+		db:   db,
+		name: deliveriesBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v delivery
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errDeliveryNotFound,
+	}}
+}
+
+func (s *boltDeliveryStore) List() ([]delivery, error) {
+	values, err := s.list()
+	list := make([]delivery, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(delivery))
+	}
+	sortDeliveries(list)
+	return list, err
+}
+
+func (s *boltDeliveryStore) Get(id string) (delivery, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return delivery{}, err
+	}
+	return v.(delivery), nil
+}
+
+func (s *boltDeliveryStore) Create(d delivery) error {
+	return s.create(d.ID, d)
+}
+
+func (s *boltDeliveryStore) Update(d delivery) error {
+	return s.update(d.ID, d)
+}
+
+// branchesBucket is the bolt bucket holding branches.
+const branchesBucket = "branches"
+
+// boltBranchStore keeps branches in the same bbolt database file as the catalog.
+type boltBranchStore struct {
+	boltBucket
+}
+
+func newBoltBranchStore(db *bolt.DB) *boltBranchStore {
+	return &boltBranchStore{boltBucket{
+		db:   db,
+		name: branchesBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v branch
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errBranchNotFound,
+		exists:   errBranchExists,
+	}}
+}
+
+func (s *boltBranchStore) List() ([]branch, error) {
+	values, err := s.list()
+	list := make([]branch, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(branch))
+	}
+	sortBranches(list)
+	return list, err
+}
+
+func (s *boltBranchStore) Get(id string) (branch, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return branch{}, err
+	}
+	return v.(branch), nil
+}
+
+func (s *boltBranchStore) Create(b branch) error {
+	return s.create(b.ID, b)
+}
+
+func (s *boltBranchStore) Update(b branch) error {
+	return s.update(b.ID, b)
+}
+
+// transfersBucket is the bolt bucket holding transfers between branches.
+const transfersBucket = "transfers"
+
+// boltTransferStore keeps transfers in the same bbolt database file as the catalog.
+type boltTransferStore struct {
+	boltBucket
+}
+
+func newBoltTransferStore(db *bolt.DB) *boltTransferStore {
+	return &boltTransferStore{boltBucket{
+		db:   db,
+		name: transfersBucket,
+		decode: func(data []byte) (interface{}, error) {
+			var v transfer
+			err := json.Unmarshal(data, &v)
+			return v, err
+		},
+		notFound: errTransferNotFound,
+	}}
+}
+
+func (s *boltTransferStore) List() ([]transfer, error) {
+	values, err := s.list()
+	list := make([]transfer, 0, len(values))
+	for _, v := range values {
+		list = append(list, v.(transfer))
+	}
+	sortTransfers(list)
+	return list, err
+}
+
+func (s *boltTransferStore) Get(id string) (transfer, error) {
+	v, err := s.get(id)
+	if err != nil {
+		return transfer{}, err
+	}
+	return v.(transfer), nil
+}
+
+func (s *boltTransferStore) Create(t transfer) error {
+	return s.create(t.ID, t)
+}
+
+func (s *boltTransferStore) Update(t transfer) error {
+	return s.update(t.ID, t)
+}
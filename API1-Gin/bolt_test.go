@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStores(t *testing.T) {
+	db, err := openBoltDB(filepath.Join(t.TempDir(), "library.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	books, seeded, err := newBoltBookStore(db, seedBooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeded) != len(seedBooks) {
+		t.Fatalf("got %d seeded books, want %d", len(seeded), len(seedBooks))
+	}
+	if _, again, err := newBoltBookStore(db, seedBooks); err != nil || len(again) != 0 {
+		t.Errorf("reopening: got %d seeded books, %v, want none", len(again), err)
+	}
+	if all, err := books.List(); err != nil || len(all) != len(seedBooks) {
+		t.Errorf("got %d books, %v, want %d", len(all), err, len(seedBooks))
+	}
+	b, err := books.Get("1")
+	if err != nil || b.Title != seedBooks[0].Title {
+		t.Fatalf("got %+v, %v, want the first seed book", b, err)
+	}
+	if _, err := books.Get("nope"); !errors.Is(err, errBookNotFound) {
+		t.Errorf("Get unknown: got %v, want errBookNotFound", err)
+	}
+	if _, err := books.Create(b); !errors.Is(err, errBookExists) {
+		t.Errorf("Create existing: got %v, want errBookExists", err)
+	}
+	b.Quantity++
+	updated, err := books.Update(b)
+	if err != nil || updated.Version != b.Version+1 {
+		t.Fatalf("got %+v, %v, want the next version", updated, err)
+	}
+	if _, err := books.Update(b); !errors.Is(err, errVersionConflict) {
+		t.Errorf("Update stale: got %v, want errVersionConflict", err)
+	}
+	if err := books.Delete("1", b.Version); !errors.Is(err, errVersionConflict) {
+		t.Errorf("Delete stale: got %v, want errVersionConflict", err)
+	}
+	if err := books.Delete("1", updated.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := books.Delete("1", updated.Version); !errors.Is(err, errBookNotFound) {
+		t.Errorf("Delete twice: got %v, want errBookNotFound", err)
+	}
+
+	copies := newBoltItemStore(db)
+	it := item{Barcode: "C1", BookID: "2", Status: itemAvailable}
+	if err := copies.Create(it); err != nil {
+		t.Fatal(err)
+	}
+	if err := copies.Create(it); !errors.Is(err, errItemExists) {
+		t.Errorf("Create existing copy: got %v, want errItemExists", err)
+	}
+	it.Status = itemOnLoan
+	if err := copies.Update(it); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := copies.Get("C1"); err != nil || got != it {
+		t.Errorf("got %+v, %v, want %+v", got, err, it)
+	}
+	if err := copies.Update(item{Barcode: "C2"}); !errors.Is(err, errItemNotFound) {
+		t.Errorf("Update unknown copy: got %v, want errItemNotFound", err)
+	}
+
+	lent := newBoltLoanStore(db)
+	if err := lent.Delete("nope"); err != nil {
+		t.Errorf("Delete unknown loan: got %v, want nil", err)
+	}
+	if all, err := lent.List(); err != nil || len(all) != 0 {
+		t.Errorf("got loans %+v, %v, want none", all, err)
+	}
+}
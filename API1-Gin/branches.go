@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errBranchNotFound is returned by a BranchStore when no branch has the requested ID.
+var errBranchNotFound = errors.New("branch not found")
+
+// errBranchExists is returned by a BranchStore when a branch is created with an ID that is already taken.
+var errBranchExists = errors.New("branch already exists")
+
+// errWrongBranch is returned when a copy asked for by barcode is held at a different branch from the one given.
+var errWrongBranch = errors.New("copy is at another branch")
+
+// Limits on branch fields, checked by branchInput.validate.
+const (
+	maxBranchNameLength    = 100
+	maxBranchAddressLength = 300
+)
+
+// branchIDPattern is what a branch ID may look like. IDs are short codes such as "main" or "north-end"
+// because they are typed into query parameters.
+var branchIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// defaultBranchID is the branch that copies are added to when no branch is given, and that copies recorded
+// before there were branches belong to. It is set in main with the -default-branch flag.
+var defaultBranchID = "main"
+
+// A branch is one library building. Every copy is held at a branch.
+type branch struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BranchStore is the persistence layer for branches, with the same memory and bolt backends as BookStore.
+type BranchStore interface {
+	// List returns every branch, ordered by ID.
+	List() ([]branch, error)
+	// Get returns the branch with the given ID, or errBranchNotFound.
+	Get(id string) (branch, error)
+	// Create adds a new branch, or returns errBranchExists if the ID is already taken.
+	Create(b branch) error
+	// Update overwrites an existing branch, or returns errBranchNotFound.
+	Update(b branch) error
+}
+
+// branches holds every branch. It is chosen in main alongside store.
+var branches BranchStore
+
+// memoryBranchStore keeps branches in a map, so they are lost when the process exits.
+type memoryBranchStore struct {
+	mu       sync.RWMutex
+	branches map[string]branch
+}
+
+func newMemoryBranchStore() *memoryBranchStore {
+	return &memoryBranchStore{branches: map[string]branch{}}
+}
+
+func (s *memoryBranchStore) List() ([]branch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]branch, 0, len(s.branches))
+	for _, b := range s.branches {
+		list = append(list, b)
+	}
+	sortBranches(list)
+	return list, nil
+}
+
+func (s *memoryBranchStore) Get(id string) (branch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return branch{}, errBranchNotFound
+	}
+	return b, nil
+}
+
+func (s *memoryBranchStore) Create(b branch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.branches[b.ID]; ok {
+		return errBranchExists
+	}
+	s.branches[b.ID] = b
+	return nil
+}
+
+func (s *memoryBranchStore) Update(b branch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.branches[b.ID]; !ok {
+		return errBranchNotFound
+	}
+	s.branches[b.ID] = b
+	return nil
+}
+
+// sortBranches orders branches by ID.
+func sortBranches(list []branch) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+}
+
+// backfillBranches makes sure the default branch exists and moves every copy that has no branch into it,
+// so catalogs saved before there were branches keep working. The changes are written to the event log.
+func backfillBranches() error {
+	if _, err := branches.Get(defaultBranchID); errors.Is(err, errBranchNotFound) {
+		b := branch{ID: defaultBranchID, Name: "Main library", CreatedAt: time.Now().UTC()}
+		if err := branches.Create(b); err != nil {
+			return err
+		}
+		if _, err := appendEvent("", event{Type: eventBranchCreated, Branch: &b}); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	homeless, err := filterItems(func(it item) bool {
+		return it.BranchID == ""
+	})
+	if err != nil {
+		return err
+	}
+	for i := range homeless {
+		homeless[i].BranchID = defaultBranchID
+		if err := items.Update(homeless[i]); err != nil {
+			return err
+		}
+		if _, err := appendEvent("", event{Type: eventItemUpdated, Item: &homeless[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respondBranchError writes the HTTP response for an error returned by the branch store.
+func respondBranchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBranchNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Branch not found."})
+	case errors.Is(err, errBranchExists):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "A branch with this ID already exists."})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load branches."})
+	}
+}
+
+// branchInput is the body accepted when creating or updating a branch. The ID cannot be changed once the branch exists.
+type branchInput struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// validate trims the input and returns the problems found, keyed by field. The ID is only checked when creating.
+func (in *branchInput) validate(creating bool) map[string]string {
+	in.ID = strings.TrimSpace(in.ID)
+	in.Name = strings.TrimSpace(in.Name)
+	in.Address = strings.TrimSpace(in.Address)
+	problems := map[string]string{}
+	if creating && !branchIDPattern.MatchString(in.ID) {
+		problems["id"] = "must be 1 to 32 lowercase letters, digits or hyphens"
+	}
+	if in.Name == "" {
+		problems["name"] = "is required"
+	} else if len(in.Name) > maxBranchNameLength {
+		problems["name"] = "must be at most 100 characters"
+	}
+	if len(in.Address) > maxBranchAddressLength {
+		problems["address"] = "must be at most 300 characters"
+	}
+	return problems
+}
+
+// listBranches handles GET /branches.
+func listBranches(c *gin.Context) {
+	list, err := branches.List()
+	if err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getBranch handles GET /branches/:id.
+func getBranch(c *gin.Context) {
+	b, err := branches.Get(c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, b)
+}
+
+// createBranch handles POST /branches.
+func createBranch(c *gin.Context) {
+	var input branchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON branch."})
+		return
+	}
+	if problems := input.validate(true); len(problems) > 0 {
+		respondValidationErrors(c, problems)
+		return
+	}
+	b := branch{ID: input.ID, Name: input.Name, Address: input.Address, CreatedAt: time.Now().UTC()}
+	if err := branches.Create(b); err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventBranchCreated, Branch: &b}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, b)
+}
+
+// updateBranch handles PUT /branches/:id and replaces the branch's name and address.
+func updateBranch(c *gin.Context) {
+	var input branchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON branch."})
+		return
+	}
+	if problems := input.validate(false); len(problems) > 0 {
+		respondValidationErrors(c, problems)
+		return
+	}
+	b, err := branches.Get(c.Param("id"))
+	if err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	b.Name, b.Address = input.Name, input.Address
+	if err := branches.Update(b); err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventBranchUpdated, Branch: &b}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, b)
+}
+
+// A stockLevel counts the copies of a book at one branch by status. Withdrawn copies are left out.
+// Copies in transit are counted at the branch they left until they are received.
+type stockLevel struct {
+	BranchID  string `json:"branch_id"`
+	BookID    string `json:"book_id"`
+	Available int    `json:"available"`
+	OnLoan    int    `json:"on_loan"`
+	Reserved  int    `json:"reserved"`
+	InTransit int    `json:"in_transit"`
+}
+
+// countStock adds up the copies for which keep returns true, one stockLevel per book and branch.
+func countStock(keep func(item) bool) ([]stockLevel, error) {
+	list, err := filterItems(func(it item) bool {
+		return it.Status != itemWithdrawn && keep(it)
+	})
+	if err != nil {
+		return nil, err
+	}
+	levels := []stockLevel{}
+	index := map[[2]string]int{}
+	for _, it := range list {
+		key := [2]string{it.BranchID, it.BookID}
+		i, ok := index[key]
+		if !ok {
+			i = len(levels)
+			index[key] = i
+			levels = append(levels, stockLevel{BranchID: it.BranchID, BookID: it.BookID})
+		}
+		switch it.Status {
+		case itemAvailable:
+			levels[i].Available++
+		case itemOnLoan:
+			levels[i].OnLoan++
+		case itemReserved:
+			levels[i].Reserved++
+		case itemInTransit:
+			levels[i].InTransit++
+		}
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if levels[i].BranchID != levels[j].BranchID {
+			return levels[i].BranchID < levels[j].BranchID
+		}
+		return levels[i].BookID < levels[j].BookID
+	})
+	return levels, nil
+}
+
+// bookStock handles GET /books/:id/stock and shows how many copies of the book each branch has.
+func bookStock(c *gin.Context) {
+	bookID := c.Param("id")
+	if _, err := store.Get(bookID); err != nil {
+		respondBookError(c, err)
+		return
+	}
+	levels, err := countStock(func(it item) bool {
+		return it.BookID == bookID
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list copies."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, levels)
+}
+
+// branchStock handles GET /branches/:id/stock and shows how many copies of each book the branch has.
+func branchStock(c *gin.Context) {
+	branchID := c.Param("id")
+	if _, err := branches.Get(branchID); err != nil {
+		respondBranchError(c, err)
+		return
+	}
+	levels, err := countStock(func(it item) bool {
+		return it.BranchID == branchID
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list copies."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, levels)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTitleLength, maxAuthorLength and maxTypeLength bound the text fields of a book.
+const (
+	maxTitleLength  = 300
+	maxAuthorLength = 200
+	maxTypeLength   = 50
+)
+
+// validate checks the fields a client may set and returns a message for each invalid one, keyed by its JSON name.
+// It returns nil if the book is valid. A valid ISBN is rewritten in its 13-digit form and an empty type becomes defaultBookType.
+func (b *book) validate() map[string]string {
+	errs := map[string]string{}
+	if strings.TrimSpace(b.ISBN) == "" {
+		errs["isbn"] = "is required"
+	} else if isbn, err := normalizeISBN(b.ISBN); err != nil {
+		errs["isbn"] = err.Error()
+	} else {
+		b.ISBN = isbn
+	}
+	switch title := strings.TrimSpace(b.Title); {
+	case title == "":
+		errs["title"] = "is required"
+	case utf8.RuneCountInString(title) > maxTitleLength:
+		errs["title"] = "must be at most " + strconv.Itoa(maxTitleLength) + " characters"
+	}
+	switch author := strings.TrimSpace(b.Author); {
+	case author == "":
+		errs["author"] = "is required"
+	case utf8.RuneCountInString(author) > maxAuthorLength:
+		errs["author"] = "must be at most " + strconv.Itoa(maxAuthorLength) + " characters"
+	}
+	b.Type = strings.ToLower(strings.TrimSpace(b.Type))
+	if b.Type == "" {
+		b.Type = defaultBookType
+	} else if utf8.RuneCountInString(b.Type) > maxTypeLength {
+		errs["type"] = "must be at most " + strconv.Itoa(maxTypeLength) + " characters"
+	}
+	if b.Quantity < 0 {
+		errs["quantity"] = "must not be negative"
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// respondValidationErrors writes a 422 Unprocessable Entity response listing the invalid fields.
+func respondValidationErrors(c *gin.Context, errs map[string]string) {
+	c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"message": "Validation failed.", "errors": errs})
+}
+
+// isbnTaken reports whether a book other than the one with ID exceptID already has the ISBN.
+func isbnTaken(isbn, exceptID string) (bool, error) {
+	books, err := store.List()
+	if err != nil {
+		return false, err
+	}
+	for _, b := range books {
+		if b.ISBN == isbn && b.ID != exceptID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// errISBNTaken is returned through updateBook when a book is given the ISBN of another book.
+var errISBNTaken = validationError{"isbn": "is already used by another book"}
+
+// validationError wraps per-field messages so they can be returned through updateBook.
+type validationError map[string]string
+
+func (e validationError) Error() string {
+	return "validation failed"
+}
+
+// putBook handles PUT /books/:id and replaces the ISBN, title, author and type of a book.
+// The ID comes from the path and the version from If-Match; any id, version or quantity in the body is ignored,
+// since quantity follows the book's copies.
+func putBook(c *gin.Context) {
+	var replacement book
+	if err := c.ShouldBindJSON(&replacement); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON book."})
+		return
+	}
+	replacement.Quantity = 0
+	if errs := replacement.validate(); errs != nil {
+		respondValidationErrors(c, errs)
+		return
+	}
+
+	// Hold circulationMu so the ISBN cannot be taken by another book while this one is saved.
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	id := c.Param("id")
+	saved, err := updateBook(id, c.GetHeader("If-Match"), func(b *book) error {
+		if taken, err := isbnTaken(replacement.ISBN, id); err != nil {
+			return err
+		} else if taken {
+			return errISBNTaken
+		}
+		b.ISBN = replacement.ISBN
+		b.Title = replacement.Title
+		b.Author = replacement.Author
+		b.Type = replacement.Type
+		return nil
+	})
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		respondValidationErrors(c, invalid)
+		return
+	}
+	if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventBookUpdated, Book: &saved}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	setBookETag(c, saved)
+	c.IndentedJSON(http.StatusOK, saved)
+}
+
+// patchBook handles PATCH /books/:id with a JSON Merge Patch (RFC 7396) body: members present in the patch replace
+// the book's fields and members set to null reset them. The id and quantity cannot be changed, and version is ignored in favour of If-Match.
+func patchBook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Could not read request body."})
+		return
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON merge patch object."})
+		return
+	}
+
+	// Hold circulationMu so the ISBN cannot be taken by another book while this one is saved.
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	saved, err := updateBook(c.Param("id"), c.GetHeader("If-Match"), func(b *book) error {
+		patched, err := applyMergePatch(*b, patch)
+		if err != nil {
+			return err
+		}
+		errs := patched.validate()
+		if errs == nil {
+			errs = map[string]string{}
+		}
+		if patched.ID != b.ID {
+			errs["id"] = "is read-only"
+		}
+		if patched.Quantity != b.Quantity {
+			errs["quantity"] = "is read-only, add or withdraw copies instead"
+		}
+		if len(errs) > 0 {
+			return validationError(errs)
+		}
+		if taken, err := isbnTaken(patched.ISBN, b.ID); err != nil {
+			return err
+		} else if taken {
+			return errISBNTaken
+		}
+		patched.Version = b.Version
+		*b = patched
+		return nil
+	})
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		respondValidationErrors(c, invalid)
+		return
+	}
+	if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventBookUpdated, Book: &saved}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	setBookETag(c, saved)
+	c.IndentedJSON(http.StatusOK, saved)
+}
+
+// applyMergePatch returns the book with the merge patch applied to its JSON form.
+func applyMergePatch(b book, patch map[string]interface{}) (book, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return book{}, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return book{}, err
+	}
+	data, err = json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return book{}, err
+	}
+	var patched book
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return book{}, validationError{"body": "has a field of the wrong type"}
+	}
+	return patched, nil
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+		t[name] = mergePatch(t[name], value)
+	}
+	return t
+}
+
+// deleteBook handles DELETE /books/:id. A book cannot be deleted while any of its copies are on loan.
+// Its copies are deleted with it and holds still waiting for the book are cancelled.
+func deleteBook(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	id := c.Param("id")
+	b, err := store.Get(id)
+	if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	ifMatch := c.GetHeader("If-Match")
+	if !etagMatches(ifMatch, b) {
+		respondBookError(c, errPreconditionFailed)
+		return
+	}
+
+	onLoan, err := filterLoans(func(l loan) bool {
+		return l.BookID == id && l.open()
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list loans."})
+		return
+	}
+	if len(onLoan) > 0 {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Book has copies on loan and cannot be deleted.", "loans": len(onLoan)})
+		return
+	}
+	moving, err := filterTransfers(func(t transfer) bool {
+		return t.BookID == id && (t.Status == transferRequested || t.Status == transferInTransit)
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list transfers."})
+		return
+	}
+	for _, t := range moving {
+		if t.Status == transferInTransit {
+			c.IndentedJSON(http.StatusConflict, gin.H{"message": "Book has copies in transit between branches and cannot be deleted."})
+			return
+		}
+	}
+
+	copies, err := filterItems(func(it item) bool {
+		return it.BookID == id
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list copies."})
+		return
+	}
+	queued, err := filterHolds(func(h hold) bool {
+		return h.BookID == id && h.active()
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list holds."})
+		return
+	}
+
+	// The holds, transfers and copies go first and the book last, so a book is never gone while records still point at it.
+	// Everything is logged once all the writes are saved; if one fails, the earlier ones are undone.
+	var undo undoLog
+	for i := range queued {
+		before := queued[i]
+		queued[i].Status = holdCancelled
+		if err := holds.Update(queued[i]); err != nil {
+			undo.rollback()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel hold."})
+			return
+		}
+		undo.add(func() error { return holds.Update(before) })
+	}
+	for i := range moving {
+		before := moving[i]
+		moving[i].Status = transferCancelled
+		if err := transfers.Update(moving[i]); err != nil {
+			undo.rollback()
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel transfer."})
+			return
+		}
+		undo.add(func() error { return transfers.Update(before) })
+	}
+	for i := range copies {
+		deleted := copies[i]
+		if err := items.Delete(deleted.Barcode); err != nil {
+			undo.rollback()
+			respondItemError(c, err)
+			return
+		}
+		undo.add(func() error { return items.Create(deleted) })
+	}
+	if err := store.Delete(id, b.Version); err != nil {
+		undo.rollback()
+		if errors.Is(err, errVersionConflict) && ifMatch != "" {
+			err = errPreconditionFailed
+		}
+		respondBookError(c, err)
+		return
+	}
+	// Putting the book back creates it again, so it starts over at version 1.
+	undo.add(func() error {
+		_, err := store.Create(b)
+		return err
+	})
+
+	logged := []event{{Type: eventBookDeleted, Book: &b}}
+	for i := range copies {
+		logged = append(logged, event{Type: eventItemDeleted, Item: &copies[i]})
+	}
+	for i := range queued {
+		logged = append(logged, event{Type: eventHoldCancelled, Hold: &queued[i]})
+	}
+	for i := range moving {
+		logged = append(logged, event{Type: eventTransferCancelled, Transfer: &moving[i]})
+	}
+	for _, e := range logged {
+		if _, err := recordEvent(c, e); err != nil {
+			undo.rollback()
+			respondEventLogError(c)
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fullItemStore is an ItemStore that takes n more copies and then fails.
+type fullItemStore struct {
+	ItemStore
+	n int
+}
+
+func (s *fullItemStore) Create(it item) error {
+	if s.n == 0 {
+		return errors.New("disk full")
+	}
+	s.n--
+	return s.ItemStore.Create(it)
+}
+
+func TestAddBookRollsBackWhenCopiesCannotBeSaved(t *testing.T) {
+	useMemoryStores(t)
+	items = &fullItemStore{ItemStore: items, n: 2}
+
+	newBook := book{ISBN: "9780743273565", Title: "The Great Gatsby", Author: "F. Scott Fitzgerald", Type: "general", Quantity: 3}
+	if _, err := addBook(desk, newBook); err == nil {
+		t.Fatal("addBook succeeded without saving every copy")
+	}
+	if all, err := store.List(); err != nil || len(all) != 0 {
+		t.Errorf("got books %+v, %v, want none", all, err)
+	}
+	if all, err := items.List(); err != nil || len(all) != 0 {
+		t.Errorf("got copies %+v, %v, want none", all, err)
+	}
+	logged, err := events.List(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range logged {
+		if e.Book != nil || e.Item != nil {
+			t.Errorf("got a %s event, want nothing logged about the book", e.Type)
+		}
+	}
+}
+
+func TestDeleteBookRollsBackWhenEventCannotBeLogged(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStores(t, oneCopy())
+	if err := holds.Create(hold{ID: "h1", BookID: "1", PatronID: "bob", Status: holdWaiting}); err != nil {
+		t.Fatal(err)
+	}
+	copies, err := items.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = failingEventLog{events}
+	router := gin.New()
+	router.Use(authenticate())
+	router.DELETE("/books/:id", deleteBook)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/books/1", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %s, want 500", w.Code, w.Body)
+	}
+	if _, err := store.Get("1"); err != nil {
+		t.Errorf("the book is gone: %v", err)
+	}
+	if it, err := items.Get(copies[0].Barcode); err != nil || it != copies[0] {
+		t.Errorf("got copy %+v, %v, want %+v", it, err, copies[0])
+	}
+	if h, err := holds.Get("h1"); err != nil || h.Status != holdWaiting {
+		t.Errorf("got hold %+v, %v, want it still waiting", h, err)
+	}
+}
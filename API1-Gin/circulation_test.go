@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// desk is the librarian every test lends and takes back copies as.
+var desk = principal{Name: "desk", Role: roleLibrarian}
+
+// useMemoryStores points every store at a new memory store holding only the given books, with a copy for each unit of Quantity.
+func useMemoryStores(t *testing.T, books ...book) {
+	t.Helper()
+	store = newMemoryBookStore(books)
+	loans = newMemoryLoanStore()
+	holds = newMemoryHoldStore()
+	items = newMemoryItemStore()
+	ledger = newMemoryLedgerStore()
+	webhooks = newMemoryWebhookStore()
+	deliveries = newMemoryDeliveryStore()
+	branches = newMemoryBranchStore()
+	transfers = newMemoryTransferStore()
+	events = newMemoryEventLog()
+	atomic.StoreInt32(&eventLogFailed, 0)
+	if err := backfillItems(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillBranches(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// oneCopy is a book with a single copy to lend.
+func oneCopy() book {
+	return book{ID: "1", ISBN: "9780142437964", Title: "In Search of Lost Time", Author: "Marcel Proust", Type: "general", Quantity: 1, Version: 1}
+}
+
+// openLoansFor returns the open loans of the book with the given ID.
+func openLoansFor(t *testing.T, bookID string) []loan {
+	t.Helper()
+	open, err := filterLoans(func(l loan) bool { return l.BookID == bookID && l.open() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return open
+}
+
+// failingLoanStore is a LoanStore whose Create always fails.
+type failingLoanStore struct{ LoanStore }
+
+func (failingLoanStore) Create(loan) error { return errors.New("disk full") }
+
+// failingEventLog is an EventLog whose Append always fails.
+type failingEventLog struct{ EventLog }
+
+func (failingEventLog) Append(event) (event, error) { return event{}, errors.New("disk full") }
+
+// racingBookStore is a BookStore where another request changes the book just before the first n updates.
+type racingBookStore struct {
+	BookStore
+	n int
+}
+
+func (s *racingBookStore) Update(b book) (book, error) {
+	if s.n > 0 {
+		s.n--
+		current, err := s.BookStore.Get(b.ID)
+		if err != nil {
+			return book{}, err
+		}
+		current.Title += "!"
+		if _, err := s.BookStore.Update(current); err != nil {
+			return book{}, err
+		}
+	}
+	return s.BookStore.Update(b)
+}
+
+func TestConcurrentCheckoutsOfLastCopy(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+
+	const patrons = 20
+	var wg sync.WaitGroup
+	errs := make([]error, patrons)
+	for i := 0; i < patrons; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, _, errs[i] = checkout(desk, checkoutRequest{BookID: "1", PatronID: fmt.Sprintf("p%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	lent := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			lent++
+		case !errors.Is(err, errBookUnavailable):
+			t.Errorf("patron %d: got %v, want errBookUnavailable", i, err)
+		}
+	}
+	if lent != 1 {
+		t.Errorf("%d checkouts succeeded, want exactly 1", lent)
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 0 {
+		t.Errorf("got Quantity %d, want 0", b.Quantity)
+	}
+	if open := openLoansFor(t, "1"); len(open) != 1 {
+		t.Errorf("got %d open loans, want 1", len(open))
+	}
+}
+
+func TestUpdateBookRetriesAfterConcurrentChange(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+	racing := &racingBookStore{BookStore: store, n: 2}
+	store = racing
+
+	b, err := updateBook("1", "", func(b *book) error {
+		b.Quantity++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got %v, want the third attempt to succeed", err)
+	}
+	if b.Quantity != 2 || b.Title != "In Search of Lost Time!!" {
+		t.Errorf("got %+v, want Quantity 2 on top of both concurrent changes", b)
+	}
+
+	// With If-Match the concurrent change means the caller's copy is stale, so there is no retry.
+	racing.n = 1
+	_, err = updateBook("1", bookETag(b), func(b *book) error {
+		b.Quantity++
+		return nil
+	})
+	if !errors.Is(err, errPreconditionFailed) {
+		t.Errorf("with If-Match: got %v, want errPreconditionFailed", err)
+	}
+}
+
+func TestCheckoutWithStaleETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStores(t, oneCopy())
+	router := gin.New()
+	router.Use(authenticate())
+	router.PATCH("/checkout", checkoutBook)
+
+	checkoutWith := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/checkout?id=1&patron=ann", nil)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := checkoutWith(`"0"`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale ETag: got %d %s, want 412", w.Code, w.Body)
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 1 || len(openLoansFor(t, "1")) != 0 {
+		t.Errorf("after a 412: got Quantity %d and a loan, want the copy still on the shelf", b.Quantity)
+	}
+
+	w := checkoutWith(bookETag(b))
+	if w.Code != http.StatusOK {
+		t.Fatalf("current ETag: got %d %s, want 200", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("ETag"), `"2"`; got != want {
+		t.Errorf("got ETag %s, want %s", got, want)
+	}
+}
+
+func TestCheckoutRollsBackWhenLoanCannotBeSaved(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+	loans = failingLoanStore{loans}
+
+	if _, _, _, err := checkout(desk, checkoutRequest{BookID: "1", PatronID: "ann"}); err == nil {
+		t.Fatal("checkout succeeded without saving the loan")
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 1 {
+		t.Errorf("got Quantity %d, want 1", b.Quantity)
+	}
+	all, err := items.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Status != itemAvailable {
+		t.Errorf("got copies %+v, want the one copy available", all)
+	}
+}
+
+func TestReturnRollsBackWhenEventCannotBeLogged(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+	_, lent, l, err := checkout(desk, checkoutRequest{BookID: "1", PatronID: "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = failingEventLog{events}
+
+	if _, _, _, _, err := returnCopy(desk, returnRequest{LoanID: l.ID}); !errors.Is(err, errEventLogFailed) {
+		t.Fatalf("got %v, want errEventLogFailed", err)
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 0 {
+		t.Errorf("got Quantity %d, want 0", b.Quantity)
+	}
+	it, err := items.Get(lent.Barcode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it != lent {
+		t.Errorf("got copy %+v, want it as lent, %+v", it, lent)
+	}
+	if open := openLoansFor(t, "1"); len(open) != 1 || open[0].ID != l.ID {
+		t.Errorf("got open loans %+v, want the loan still open", open)
+	}
+}
+
+func TestExpireHoldsRollsBackWhenEventCannotBeLogged(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+	_, lent, l, err := checkout(desk, checkoutRequest{BookID: "1", PatronID: "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holds.Create(hold{ID: "h1", BookID: "1", PatronID: "bob", Status: holdWaiting, PlacedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := returnCopy(desk, returnRequest{LoanID: l.ID}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := holds.Get("h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().UTC().Add(-time.Minute)
+	h.ExpiresAt = &past
+	if err := holds.Update(h); err != nil {
+		t.Fatal(err)
+	}
+	working := events
+	events = failingEventLog{working}
+
+	if err := expireHolds(); !errors.Is(err, errEventLogFailed) {
+		t.Fatalf("got %v, want errEventLogFailed", err)
+	}
+	if got, err := holds.Get("h1"); err != nil || got.Status != holdReady {
+		t.Errorf("got hold %+v, %v, want it still ready", got, err)
+	}
+	if it, err := items.Get(lent.Barcode); err != nil || it.Status != itemReserved {
+		t.Errorf("got copy %+v, %v, want it still reserved", it, err)
+	}
+
+	events = working
+	atomic.StoreInt32(&eventLogFailed, 0)
+	if err := expireHolds(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := holds.Get("h1"); err != nil || got.Status != holdExpired {
+		t.Errorf("got hold %+v, %v, want it expired", got, err)
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 1 {
+		t.Errorf("got Quantity %d, want the copy back on the shelf", b.Quantity)
+	}
+}
+
+func TestFulfilHoldNotifiesCheckout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useMemoryStores(t, oneCopy())
+	_, _, l, err := checkout(desk, checkoutRequest{BookID: "1", PatronID: "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holds.Create(hold{ID: "h1", BookID: "1", PatronID: "bob", Status: holdWaiting, PlacedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := returnCopy(desk, returnRequest{LoanID: l.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webhooks.Create(webhook{ID: "w1", URL: "https://example.org/hooks", Events: []string{eventCheckedOut}}); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(authenticate())
+	router.PATCH("/holds/:id/fulfil", fulfilHold)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/holds/h1/fulfil", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+	queued, err := deliveries.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].Event != eventCheckedOut {
+		t.Fatalf("got deliveries %+v, want one book.checked_out", queued)
+	}
+	var e event
+	if err := json.Unmarshal(queued[0].Payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Book == nil || e.Book.ID != "1" || e.Item == nil || e.Item.Status != itemOnLoan || e.Loan == nil || e.Loan.PatronID != "bob" || e.Hold != nil {
+		t.Errorf("got payload %s, want the book, the copy on loan and bob's loan", queued[0].Payload)
+	}
+}
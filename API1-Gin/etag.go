@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errBookUnavailable is returned when a checkout is attempted on a book with no copies left.
+var errBookUnavailable = errors.New("book not available")
+
+// errPreconditionFailed is returned when the request's If-Match header does not match the stored book.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// maxUpdateAttempts is how many times updateBook re-reads and retries a change that lost a race with another writer.
+const maxUpdateAttempts = 5
+
+// circulationMu serialises changes to loans and holds, so for example the same loan cannot be returned twice by concurrent requests
+// and a returned copy is reserved for exactly one holder.
+var circulationMu sync.Mutex
+
+// bookETag returns the entity tag for the current version of a book.
+func bookETag(b book) string {
+	return `"` + strconv.Itoa(b.Version) + `"`
+}
+
+// setBookETag sets the ETag response header for the book.
+func setBookETag(c *gin.Context, b book) {
+	c.Header("ETag", bookETag(b))
+}
+
+// etagMatches reports whether an If-Match header value matches the book. An empty header or "*" matches anything.
+func etagMatches(ifMatch string, b book) bool {
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == bookETag(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateBook reads the book with the given ID, applies change to it and saves it.
+// If another request saved the book in between, the whole read-modify-write is retried on the fresh copy,
+// unless the client sent If-Match: then the client's view is stale and errPreconditionFailed is returned.
+func updateBook(id, ifMatch string, change func(*book) error) (book, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		b, err := store.Get(id)
+		if err != nil {
+			return book{}, err
+		}
+		if !etagMatches(ifMatch, b) {
+			return book{}, errPreconditionFailed
+		}
+		if err := change(&b); err != nil {
+			return book{}, err
+		}
+		saved, err := store.Update(b)
+		if errors.Is(err, errVersionConflict) {
+			if ifMatch != "" {
+				return book{}, errPreconditionFailed
+			}
+			continue
+		}
+		return saved, err
+	}
+	return book{}, errVersionConflict
+}
+
+// respondBookError writes the HTTP response for an error returned by updateBook or the store.
+func respondBookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBookNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
+	case errors.Is(err, errBookUnavailable):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Book not available."})
+	case errors.Is(err, errPreconditionFailed):
+		c.IndentedJSON(http.StatusPreconditionFailed, gin.H{"message": "Book has changed since it was read."})
+	case errors.Is(err, errVersionConflict):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Book is being modified by other requests, try again."})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not update book."})
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The types of event written to the log. Each event carries the records it changed, as they were after the change.
+const (
+	eventBookCreated   = "book.created"
+	eventBookUpdated   = "book.updated"
+	eventBookDeleted   = "book.deleted"
+	eventItemAdded     = "item.added"
+	eventItemUpdated   = "item.updated"
+	eventItemWithdrawn = "item.withdrawn"
+	eventItemDeleted   = "item.deleted"
+	eventCheckedOut    = "book.checked_out"
+	eventReturned      = "book.returned"
+	eventRenewed       = "loan.renewed"
+	eventCopyReleased  = "copy.released"
+	eventHoldPlaced    = "hold.placed"
+	eventHoldCancelled = "hold.cancelled"
+	eventHoldExpired   = "hold.expired"
+	eventHoldFulfilled = "hold.fulfilled"
+	eventPayment       = "account.payment"
+	eventWaiver        = "account.waiver"
+	eventBranchCreated = "branch.created"
+	eventBranchUpdated = "branch.updated"
+	eventSnapshot      = "snapshot"
+
+	eventTransferRequested  = "transfer.requested"
+	eventTransferDispatched = "transfer.dispatched"
+	eventTransferReceived   = "transfer.received"
+	eventTransferCancelled  = "transfer.cancelled"
+)
+
+// An event is one entry of the circulation log. Seq numbers start at 1 and increase by one per event.
+// The record fields hold snapshots of whatever the action touched; for deletions they hold the record as it was before.
+type event struct {
+	Seq      int64        `json:"seq"`
+	Type     string       `json:"type"`
+	At       time.Time    `json:"at"`
+	Actor    string       `json:"actor,omitempty"`
+	Book     *book        `json:"book,omitempty"`
+	Item     *item        `json:"item,omitempty"`
+	Loan     *loan        `json:"loan,omitempty"`
+	Hold     *hold        `json:"hold,omitempty"`
+	Entry    *ledgerEntry `json:"entry,omitempty"`
+	Branch   *branch      `json:"branch,omitempty"`
+	Transfer *transfer    `json:"transfer,omitempty"`
+}
+
+// EventLog is the append-only history of every catalog and circulation action.
+type EventLog interface {
+	// Append gives the event the next sequence number, saves it and returns it.
+	Append(e event) (event, error)
+	// List returns up to limit events with a sequence number greater than after, oldest first.
+	List(after int64, limit int) ([]event, error)
+}
+
+// events is the log every handler writes to. It is chosen in main with the -event-log flag.
+var events EventLog
+
+// memoryEventLog keeps the log in a slice. It is used when no -event-log file is given, so history is lost on restart.
+type memoryEventLog struct {
+	mu     sync.RWMutex
+	events []event
+}
+
+func newMemoryEventLog() *memoryEventLog {
+	return &memoryEventLog{}
+}
+
+func (l *memoryEventLog) Append(e event) (event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = int64(len(l.events)) + 1
+	l.events = append(l.events, e)
+	return e, nil
+}
+
+func (l *memoryEventLog) List(after int64, limit int) ([]event, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// Sequence numbers are dense, so event n is at index n-1.
+	if after < 0 {
+		after = 0
+	}
+	if after >= int64(len(l.events)) {
+		return []event{}, nil
+	}
+	end := after + int64(limit)
+	if end > int64(len(l.events)) {
+		end = int64(len(l.events))
+	}
+	return append([]event(nil), l.events[after:end]...), nil
+}
+
+// fileEventLog appends each event as a line of JSON to a file and syncs it before returning.
+// The whole log is also kept in memory to serve List.
+type fileEventLog struct {
+	memoryEventLog
+	file logFile
+}
+
+// logFile is the part of *os.File that fileEventLog writes through.
+type logFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// openFileEventLog opens (or creates) a JSON Lines event log and loads the events already in it.
+func openFileEventLog(path string) (*fileEventLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &fileEventLog{file: f}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, errors.New("event log line " + strconv.Itoa(len(l.events)+1) + ": " + err.Error())
+		}
+		l.events = append(l.events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *fileEventLog) Append(e event) (event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = int64(len(l.events)) + 1
+	data, err := json.Marshal(e)
+	if err != nil {
+		return event{}, err
+	}
+	// A write that fails part of the way leaves half a line, which would stop the log from being opened again,
+	// so the file is cut back to where the event started.
+	offset, err := l.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return event{}, err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		if terr := l.file.Truncate(offset); terr != nil {
+			return event{}, errors.New(err.Error() + ", and the partial event could not be removed: " + terr.Error())
+		}
+		return event{}, err
+	}
+	l.events = append(l.events, e)
+	return e, nil
+}
+
+// Close closes the log file.
+func (l *fileEventLog) Close() error {
+	return l.file.Close()
+}
+
+// errEventLogFailed is returned by appendEvent when the log cannot be written, and by eventLogWritable from then on.
+var errEventLogFailed = errors.New("event log cannot be written")
+
+// eventLogFailed is set to 1 the first time an event cannot be written. The stores then hold a change the log is missing,
+// so no further changes are accepted until the server is restarted and the operator has looked at the log.
+var eventLogFailed int32
+
+// eventLogWritable returns errEventLogFailed once an event could not be written, and nil before that.
+func eventLogWritable() error {
+	if atomic.LoadInt32(&eventLogFailed) != 0 {
+		return errEventLogFailed
+	}
+	return nil
+}
+
+// recordEvent appends an event for an action taken by the caller of the request and returns it as logged.
+// The state change has already been saved, so on error the handler must fail the request with respondEventLogError.
+func recordEvent(c *gin.Context, e event) (event, error) {
+	return appendEvent(caller(c).Name, e)
+}
+
+// appendEvent appends an event on behalf of actor, which is empty for actions the server takes by itself.
+// If the log cannot be written it returns errEventLogFailed and the server stops accepting changes.
+func appendEvent(actor string, e event) (event, error) {
+	e.At = time.Now().UTC()
+	e.Actor = actor
+	saved, err := events.Append(e)
+	if err != nil {
+		log.Printf("Error writing %s event to the log, no further changes are accepted: %v", e.Type, err)
+		atomic.StoreInt32(&eventLogFailed, 1)
+		return e, errEventLogFailed
+	}
+	return saved, nil
+}
+
+// respondEventLogError writes the HTTP response for a request whose change could not be written to the event log.
+func respondEventLogError(c *gin.Context) {
+	c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not write the change to the event log. No further changes are accepted until the server is restarted."})
+}
+
+// refuseWritesAfterLogFailure is Gin middleware that answers 503 Service Unavailable to every request that could change
+// something once an event could not be written. GraphQL is let through, as its mutations check eventLogWritable themselves.
+func refuseWritesAfterLogFailure() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || c.FullPath() == "/graphql" {
+			return
+		}
+		if eventLogWritable() != nil {
+			c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"message": "The event log cannot be written, so no changes are accepted until the server is restarted."})
+			c.Abort()
+		}
+	}
+}
+
+// eventLogEmpty reports whether nothing has been written to the log yet.
+func eventLogEmpty() (bool, error) {
+	existing, err := events.List(0, 1)
+	return len(existing) == 0, err
+}
+
+// snapshotState writes the current state of every store to an empty log, so that replaying the log later
+// starts from the catalog the log was started with. Changes made to the stores after it, such as backfills, must be logged as events.
+func snapshotState() error {
+	if empty, err := eventLogEmpty(); err != nil || !empty {
+		return err
+	}
+	books, err := store.List()
+	if err != nil {
+		return err
+	}
+	for i := range books {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Book: &books[i]}); err != nil {
+			return err
+		}
+	}
+	allItems, err := items.List()
+	if err != nil {
+		return err
+	}
+	for i := range allItems {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Item: &allItems[i]}); err != nil {
+			return err
+		}
+	}
+	allLoans, err := loans.List()
+	if err != nil {
+		return err
+	}
+	for i := range allLoans {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Loan: &allLoans[i]}); err != nil {
+			return err
+		}
+	}
+	allHolds, err := holds.List()
+	if err != nil {
+		return err
+	}
+	for i := range allHolds {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Hold: &allHolds[i]}); err != nil {
+			return err
+		}
+	}
+	entries, err := ledger.List()
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Entry: &entries[i]}); err != nil {
+			return err
+		}
+	}
+	allBranches, err := branches.List()
+	if err != nil {
+		return err
+	}
+	for i := range allBranches {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Branch: &allBranches[i]}); err != nil {
+			return err
+		}
+	}
+	allTransfers, err := transfers.List()
+	if err != nil {
+		return err
+	}
+	for i := range allTransfers {
+		if _, err := appendEvent("", event{Type: eventSnapshot, Transfer: &allTransfers[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayEvents rebuilds the in-memory stores from the log. Each event's snapshots overwrite the stored records,
+// and book.deleted and item.deleted events remove them.
+func replayEvents() error {
+	bookStore := newMemoryBookStore(nil)
+	itemStore := newMemoryItemStore()
+	loanStore := newMemoryLoanStore()
+	holdStore := newMemoryHoldStore()
+	ledgerStore := newMemoryLedgerStore()
+	branchStore := newMemoryBranchStore()
+	transferStore := newMemoryTransferStore()
+
+	var after int64
+	for {
+		batch, err := events.List(after, 1000)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, e := range batch {
+			if e.Book != nil {
+				if e.Type == eventBookDeleted {
+					bookStore.remove(e.Book.ID)
+				} else {
+					bookStore.put(*e.Book)
+				}
+			}
+			if e.Item != nil {
+				if e.Type == eventItemDeleted {
+					delete(itemStore.items, e.Item.Barcode)
+				} else {
+					itemStore.items[e.Item.Barcode] = *e.Item
+				}
+			}
+			if e.Loan != nil {
+				loanStore.loans[e.Loan.ID] = *e.Loan
+			}
+			if e.Hold != nil {
+				holdStore.holds[e.Hold.ID] = *e.Hold
+			}
+			if e.Entry != nil {
+				ledgerStore.entries = append(ledgerStore.entries, *e.Entry)
+			}
+			if e.Branch != nil {
+				branchStore.branches[e.Branch.ID] = *e.Branch
+			}
+			if e.Transfer != nil {
+				transferStore.transfers[e.Transfer.ID] = *e.Transfer
+			}
+			after = e.Seq
+		}
+	}
+
+	store, items, loans, holds, ledger = bookStore, itemStore, loanStore, holdStore, ledgerStore
+	branches, transfers = branchStore, transferStore
+	log.Printf("Replayed %d events from the log", after)
+	return nil
+}
+
+// listEvents handles GET /events?after=<seq>&limit=<n> and returns a page of the log.
+// Pass the returned next_after as after to get the following page.
+func listEvents(c *gin.Context) {
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil || after < 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "after must be a non-negative integer"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+		return
+	}
+	page, err := events.List(after, limit)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not read the event log."})
+		return
+	}
+	next := after
+	if len(page) > 0 {
+		next = page[len(page)-1].Seq
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"events": page, "next_after": next})
+}
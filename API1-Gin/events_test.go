@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// tornLogFile is a logFile whose writes fail after writing only the first half of what they were given,
+// as when the disk fills up in the middle of an event.
+type tornLogFile struct{ logFile }
+
+func (f tornLogFile) Write(p []byte) (int, error) {
+	n, err := f.logFile.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, errors.New("disk full")
+}
+
+func TestReplayAfterFailedAppend(t *testing.T) {
+	useMemoryStores(t, oneCopy())
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := openFileEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = l
+	if err := snapshotState(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, lent, err := checkout(desk, checkoutRequest{BookID: "1", PatronID: "ann"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.file = tornLogFile{l.file}
+	if _, _, _, _, err := returnCopy(desk, returnRequest{LoanID: lent.ID}); !errors.Is(err, errEventLogFailed) {
+		t.Fatalf("got %v, want errEventLogFailed", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log must open again without the half-written return, and replay to the copy still being on loan.
+	reopened, err := openFileEventLog(path)
+	if err != nil {
+		t.Fatalf("reopening the log: %v", err)
+	}
+	defer reopened.Close()
+	events = reopened
+	if err := replayEvents(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Quantity != 0 {
+		t.Errorf("got Quantity %d, want 0", b.Quantity)
+	}
+	if open := openLoansFor(t, "1"); len(open) != 1 || open[0].ID != lent.ID {
+		t.Errorf("got open loans %+v, want the loan from before the failure", open)
+	}
+
+	// Events appended after reopening follow on from the last whole one.
+	e, err := reopened.Append(event{Type: eventReturned})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := reopened.List(0, 1000); e.Seq != int64(len(all)) {
+		t.Errorf("got Seq %d, want %d", e.Seq, len(all))
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errFinesOutstanding is returned when a patron owes more than the policy allows and may not borrow.
+var errFinesOutstanding = errors.New("patron has outstanding fines")
+
+// The kinds of ledger entry. Fines add to a patron's balance, payments and waivers take it off again.
+const (
+	entryFine    = "fine"
+	entryPayment = "payment"
+	entryWaiver  = "waiver"
+)
+
+// defaultBookType is the type used for fines when a book has none.
+const defaultBookType = "general"
+
+// A finePolicy says how much a late return costs. All amounts are in cents.
+// Types overrides the rate, grace period or cap for books of a given type; fields left out fall back to the defaults.
+type finePolicy struct {
+	DailyRateCents    int64               `json:"daily_rate_cents"`
+	GraceDays         int                 `json:"grace_days"`
+	MaxFineCents      int64               `json:"max_fine_cents"`
+	BlockBalanceCents int64               `json:"block_balance_cents"`
+	Types             map[string]fineRate `json:"types,omitempty"`
+}
+
+// A fineRate overrides parts of the policy for one book type.
+type fineRate struct {
+	DailyRateCents *int64 `json:"daily_rate_cents,omitempty"`
+	GraceDays      *int   `json:"grace_days,omitempty"`
+	MaxFineCents   *int64 `json:"max_fine_cents,omitempty"`
+}
+
+// defaultFinePolicy is the policy used when no -fines-policy file is given, and the base a policy file is read on top of.
+var defaultFinePolicy = finePolicy{
+	DailyRateCents:    25,
+	GraceDays:         2,
+	MaxFineCents:      1000,
+	BlockBalanceCents: 500,
+}
+
+// fines is the policy in force. It can be replaced at startup with the -fines-policy flag.
+var fines = defaultFinePolicy
+
+// loadFinePolicy reads a finePolicy from a JSON file. Keys left out of the file keep their default values,
+// so a file that only sets the daily rate does not also turn off the cap or block every patron who owes anything.
+func loadFinePolicy(path string) (finePolicy, error) {
+	p := defaultFinePolicy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	return p, p.validate()
+}
+
+// validate checks that no amount or period in the policy is negative. A MaxFineCents of 0 means no cap.
+func (p finePolicy) validate() error {
+	check := func(name string, v int64) error {
+		if v < 0 {
+			return errors.New(name + " must not be negative")
+		}
+		return nil
+	}
+	for _, err := range []error{
+		check("daily_rate_cents", p.DailyRateCents),
+		check("grace_days", int64(p.GraceDays)),
+		check("max_fine_cents", p.MaxFineCents),
+		check("block_balance_cents", p.BlockBalanceCents),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	for name, o := range p.Types {
+		if o.DailyRateCents != nil && *o.DailyRateCents < 0 ||
+			o.GraceDays != nil && *o.GraceDays < 0 ||
+			o.MaxFineCents != nil && *o.MaxFineCents < 0 {
+			return errors.New("types." + name + ": values must not be negative")
+		}
+	}
+	return nil
+}
+
+// fineFor returns the fine for returning a book of the given type at returnedAt on a loan due at dueAt.
+// Every started day late counts, but nothing is charged for the first GraceDays of them, and the total is capped at MaxFineCents.
+func (p finePolicy) fineFor(bookType string, dueAt, returnedAt time.Time) int64 {
+	rate, grace, max := p.DailyRateCents, p.GraceDays, p.MaxFineCents
+	if bookType == "" {
+		bookType = defaultBookType
+	}
+	if o, ok := p.Types[bookType]; ok {
+		if o.DailyRateCents != nil {
+			rate = *o.DailyRateCents
+		}
+		if o.GraceDays != nil {
+			grace = *o.GraceDays
+		}
+		if o.MaxFineCents != nil {
+			max = *o.MaxFineCents
+		}
+	}
+
+	if !returnedAt.After(dueAt) {
+		return 0
+	}
+	daysLate := int(math.Ceil(returnedAt.Sub(dueAt).Hours() / 24))
+	if daysLate <= grace {
+		return 0
+	}
+	fine := int64(daysLate-grace) * rate
+	if max > 0 && fine > max {
+		fine = max
+	}
+	return fine
+}
+
+// A ledgerEntry is one change to a patron's balance. Entries are never changed or removed.
+type ledgerEntry struct {
+	ID          string    `json:"id"`
+	PatronID    string    `json:"patron_id"`
+	Kind        string    `json:"kind"`
+	AmountCents int64     `json:"amount_cents"`
+	LoanID      string    `json:"loan_id,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LedgerStore is the persistence layer for fines, payments and waivers, with the same memory and bolt backends as BookStore.
+// It is append-only.
+type LedgerStore interface {
+	// List returns every entry, oldest first.
+	List() ([]ledgerEntry, error)
+	// Create appends a new entry.
+	Create(e ledgerEntry) error
+	// Delete removes an entry. It only rolls back a fine charged by a return that failed halfway (see undo.go).
+	Delete(id string) error
+}
+
+// ledger holds every fine, payment and waiver. It is chosen in main alongside store.
+var ledger LedgerStore
+
+// memoryLedgerStore keeps the ledger in a slice, so it is lost when the process exits.
+type memoryLedgerStore struct {
+	mu      sync.RWMutex
+	entries []ledgerEntry
+}
+
+func newMemoryLedgerStore() *memoryLedgerStore {
+	return &memoryLedgerStore{}
+}
+
+func (s *memoryLedgerStore) List() ([]ledgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ledgerEntry(nil), s.entries...), nil
+}
+
+func (s *memoryLedgerStore) Create(e ledgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *memoryLedgerStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// sortLedger orders entries by the time they were made, oldest first.
+func sortLedger(list []ledgerEntry) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
+
+// An account is a patron's ledger entries and the balance they add up to.
+type account struct {
+	PatronID     string        `json:"patron_id"`
+	BalanceCents int64         `json:"balance_cents"`
+	Entries      []ledgerEntry `json:"entries"`
+}
+
+// patronAccount collects the patron's ledger entries and works out what they owe.
+func patronAccount(patron string) (account, error) {
+	all, err := ledger.List()
+	if err != nil {
+		return account{}, err
+	}
+	acct := account{PatronID: patron, Entries: []ledgerEntry{}}
+	for _, e := range all {
+		if e.PatronID != patron {
+			continue
+		}
+		acct.Entries = append(acct.Entries, e)
+		if e.Kind == entryFine {
+			acct.BalanceCents += e.AmountCents
+		} else {
+			acct.BalanceCents -= e.AmountCents
+		}
+	}
+	return acct, nil
+}
+
+// checkFines returns errFinesOutstanding if the patron owes more than the policy allows to keep borrowing.
+func checkFines(patron string) error {
+	acct, err := patronAccount(patron)
+	if err != nil {
+		return err
+	}
+	if acct.BalanceCents > fines.BlockBalanceCents {
+		return errFinesOutstanding
+	}
+	return nil
+}
+
+// chargeLateReturn records the fine, if any, for a loan that has just been returned.
+func chargeLateReturn(l loan) (*ledgerEntry, error) {
+	var bookType string
+	if b, err := store.Get(l.BookID); err == nil {
+		bookType = b.Type
+	}
+	amount := fines.fineFor(bookType, l.DueAt, *l.ReturnedAt)
+	if amount == 0 {
+		return nil, nil
+	}
+	e := ledgerEntry{
+		ID:          newID(),
+		PatronID:    l.PatronID,
+		Kind:        entryFine,
+		AmountCents: amount,
+		LoanID:      l.ID,
+		Note:        "Late return",
+		CreatedAt:   *l.ReturnedAt,
+	}
+	if err := ledger.Create(e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// respondFinesOutstanding writes a 403 Forbidden response telling the patron what they owe.
+func respondFinesOutstanding(c *gin.Context, patron string) {
+	acct, _ := patronAccount(patron)
+	c.IndentedJSON(http.StatusForbidden, gin.H{
+		"message":             "Patron owes too much in fines to borrow.",
+		"balance_cents":       acct.BalanceCents,
+		"block_balance_cents": fines.BlockBalanceCents,
+	})
+}
+
+// getFinePolicy handles GET /fines/policy.
+func getFinePolicy(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, fines)
+}
+
+// getAccount handles GET /patrons/:id/account and shows the patron's balance and ledger.
+func getAccount(c *gin.Context) {
+	acct, err := patronAccount(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load account."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, acct)
+}
+
+// creditInput is the body of a payment or waiver.
+type creditInput struct {
+	AmountCents int64  `json:"amount_cents"`
+	LoanID      string `json:"loan_id"`
+	Note        string `json:"note"`
+}
+
+// recordPayment handles POST /patrons/:id/payments.
+func recordPayment(c *gin.Context) {
+	recordCredit(c, entryPayment)
+}
+
+// recordWaiver handles POST /patrons/:id/waivers.
+func recordWaiver(c *gin.Context) {
+	recordCredit(c, entryWaiver)
+}
+
+// recordCredit takes a payment or waiver off the patron's balance. It cannot take the balance below zero.
+func recordCredit(c *gin.Context, kind string) {
+	var input creditInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON " + kind + "."})
+		return
+	}
+	if input.AmountCents <= 0 {
+		respondValidationErrors(c, map[string]string{"amount_cents": "must be positive"})
+		return
+	}
+
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	patron := c.Param("id")
+	acct, err := patronAccount(patron)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load account."})
+		return
+	}
+	if input.AmountCents > acct.BalanceCents {
+		respondValidationErrors(c, map[string]string{"amount_cents": "must not exceed the balance of " + strconv.FormatInt(acct.BalanceCents, 10)})
+		return
+	}
+
+	e := ledgerEntry{
+		ID:          newID(),
+		PatronID:    patron,
+		Kind:        kind,
+		AmountCents: input.AmountCents,
+		LoanID:      input.LoanID,
+		Note:        input.Note,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := ledger.Create(e); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not record " + kind + "."})
+		return
+	}
+	eventType := eventPayment
+	if kind == entryWaiver {
+		eventType = eventWaiver
+	}
+	if _, err := recordEvent(c, event{Type: eventType, Entry: &e}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	acct.Entries = append(acct.Entries, e)
+	acct.BalanceCents -= e.AmountCents
+	c.IndentedJSON(http.StatusCreated, acct)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The media types books can be sent and imported as, besides JSON.
+const (
+	mimeCSV       = "text/csv"
+	mimeJSONLines = "application/x-ndjson"
+)
+
+// maxImportRows bounds the number of books one POST /books/import can create.
+const maxImportRows = 5000
+
+// bookCSVHeader is the header row of the CSV form of books. Imports use the same column names.
+var bookCSVHeader = []string{"id", "isbn", "title", "author", "type", "quantity", "version"}
+
+// bookFormat picks the form books are sent in: the format query parameter if given (json, csv or xml),
+// otherwise the first type in the Accept header that is offered, JSON if there is no Accept header.
+// It returns "" if none of the forms is acceptable.
+func bookFormat(c *gin.Context) string {
+	switch c.Query("format") {
+	case "json":
+		return gin.MIMEJSON
+	case "csv":
+		return mimeCSV
+	case "xml":
+		return gin.MIMEXML
+	case "":
+	default:
+		return ""
+	}
+	switch c.NegotiateFormat(gin.MIMEJSON, mimeCSV, gin.MIMEXML, gin.MIMEXML2) {
+	case gin.MIMEJSON:
+		return gin.MIMEJSON
+	case mimeCSV:
+		return mimeCSV
+	case gin.MIMEXML, gin.MIMEXML2:
+		return gin.MIMEXML
+	}
+	return ""
+}
+
+// respondNotAcceptable writes the 406 Not Acceptable response for requests bookFormat has no form for.
+func respondNotAcceptable(c *gin.Context) {
+	c.IndentedJSON(http.StatusNotAcceptable, gin.H{"message": "Books can be sent as application/json, text/csv or application/xml."})
+}
+
+// bookRow returns a book as a row under bookCSVHeader.
+func bookRow(b book) []string {
+	return []string{b.ID, b.ISBN, b.Title, b.Author, b.Type, strconv.Itoa(b.Quantity), strconv.Itoa(b.Version)}
+}
+
+// respondXML writes v as an indented XML document.
+func respondXML(c *gin.Context, status int, v interface{}) {
+	data, err := xml.MarshalIndent(v, "", "    ")
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not write XML."})
+		return
+	}
+	c.Data(status, "application/xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+// xmlBookPage is the XML form of a bookPage: a books element with the paging details as attributes.
+type xmlBookPage struct {
+	XMLName    xml.Name `xml:"books"`
+	Total      int      `xml:"total,attr"`
+	Offset     int      `xml:"offset,attr"`
+	Limit      int      `xml:"limit,attr"`
+	NextCursor string   `xml:"next_cursor,attr,omitempty"`
+	Books      []book   `xml:"book"`
+}
+
+// respondBookPage writes a page of books in the given form. The CSV form has one row per book;
+// the total and the next cursor are sent in the X-Total-Count and X-Next-Cursor headers instead.
+func respondBookPage(c *gin.Context, format string, page bookPage) {
+	switch format {
+	case mimeCSV:
+		c.Header("X-Total-Count", strconv.Itoa(page.Total))
+		if page.NextCursor != "" {
+			c.Header("X-Next-Cursor", page.NextCursor)
+		}
+		rows := [][]string{}
+		for _, b := range page.Books {
+			rows = append(rows, bookRow(b))
+		}
+		writeCSV(c, "books", bookCSVHeader, rows)
+	case gin.MIMEXML:
+		respondXML(c, http.StatusOK, xmlBookPage{Total: page.Total, Offset: page.Offset, Limit: page.Limit, NextCursor: page.NextCursor, Books: page.Books})
+	default:
+		c.IndentedJSON(http.StatusOK, page)
+	}
+}
+
+// respondBookIn writes a single book in the given form.
+func respondBookIn(c *gin.Context, format string, b book) {
+	switch format {
+	case mimeCSV:
+		writeCSV(c, "book-"+b.ID, bookCSVHeader, [][]string{bookRow(b)})
+	case gin.MIMEXML:
+		respondXML(c, http.StatusOK, b)
+	default:
+		c.IndentedJSON(http.StatusOK, b)
+	}
+}
+
+// writeCSV writes a 200 OK CSV download with the given file name, header row and rows.
+// The status has been sent by the time a write can fail, so a failed write is logged and the download is cut short.
+func writeCSV(c *gin.Context, name string, header []string, rows [][]string) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	for _, record := range append([][]string{header}, rows...) {
+		cells := make([]string, len(record))
+		for i, s := range record {
+			cells[i] = csvCell(s)
+		}
+		if err := w.Write(cells); err != nil {
+			log.Printf("Error writing %s.csv: %v", name, err)
+			return
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing %s.csv: %v", name, err)
+	}
+}
+
+// csvFormulaPrefixes are the first characters that make a spreadsheet read a cell as a formula.
+const csvFormulaPrefixes = "=+-@"
+
+// csvCell returns a value as it is written to a CSV download. A value a spreadsheet would run as a formula, such as a title
+// of "=HYPERLINK(...)", is prefixed with ' so that it is shown as text when the file is opened.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune(csvFormulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// importedCSVCell undoes csvCell, so that a CSV download can be imported again as it was.
+func importedCSVCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// An importRow is a book read from an import, with the line it started on. Err is set if the line could not be read.
+type importRow struct {
+	Line int
+	Book book
+	Err  error
+}
+
+// An importResult reports what happened to one row of an import.
+type importResult struct {
+	Line    int               `json:"line"`
+	Status  string            `json:"status"`
+	ID      string            `json:"id,omitempty"`
+	ISBN    string            `json:"isbn,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// errImportTooLarge is returned when an import has more than maxImportRows books.
+var errImportTooLarge = errors.New("import has too many rows")
+
+// readCSVImport reads books from CSV with a header row. The isbn, title and author columns are required;
+// type and quantity are optional, and id, version and any other columns are ignored.
+func readCSVImport(body io.Reader) ([]importRow, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.New("CSV must start with a header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"isbn", "title", "author"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.New("CSV header must have an " + name + " column")
+		}
+	}
+	cell := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return importedCSVCell(record[i])
+		}
+		return ""
+	}
+
+	rows := []importRow{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if len(rows) == maxImportRows {
+			return nil, errImportTooLarge
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// The rest of the file cannot be trusted after a quoting error, so the import stops at this line.
+			rows = append(rows, importRow{Line: parseErr.StartLine, Err: validationError{"line": parseErr.Err.Error()}})
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		row := importRow{Line: line, Book: book{
+			ISBN:   cell(record, "isbn"),
+			Title:  cell(record, "title"),
+			Author: cell(record, "author"),
+			Type:   cell(record, "type"),
+		}}
+		if q := strings.TrimSpace(cell(record, "quantity")); q != "" {
+			if row.Book.Quantity, err = strconv.Atoi(q); err != nil {
+				row.Err = validationError{"quantity": "must be a whole number"}
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// readJSONLinesImport reads books from JSON Lines, one JSON book per line. Blank lines are skipped.
+func readJSONLinesImport(body io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	rows := []importRow{}
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, errImportTooLarge
+		}
+		row := importRow{Line: line}
+		if err := json.Unmarshal(text, &row.Book); err != nil {
+			row.Err = validationError{"line": "must be a JSON book"}
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// importBooks handles POST /books/import and creates books in bulk from a CSV (text/csv) or JSON Lines
+// (application/x-ndjson) body. Each book is created as by POST /books, so one bad row does not stop the others;
+// the response reports the outcome of every row, by line number.
+func importBooks(c *gin.Context) {
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	var rows []importRow
+	var err error
+	switch mediaType {
+	case mimeCSV:
+		rows, err = readCSVImport(c.Request.Body)
+	case mimeJSONLines, "application/jsonl", "application/jsonlines":
+		rows, err = readJSONLinesImport(c.Request.Body)
+	default:
+		c.IndentedJSON(http.StatusUnsupportedMediaType, gin.H{"message": "Imports must be text/csv or application/x-ndjson."})
+		return
+	}
+	if errors.Is(err, errImportTooLarge) {
+		c.IndentedJSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Imports can have at most " + strconv.Itoa(maxImportRows) + " books."})
+		return
+	} else if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	who := caller(c)
+	results := make([]importResult, 0, len(rows))
+	created := 0
+	for _, row := range rows {
+		result := importResult{Line: row.Line, ISBN: row.Book.ISBN}
+		err := row.Err
+		if err == nil {
+			var b book
+			if b, err = addBook(who, row.Book); err == nil {
+				result.Status, result.ID, result.ISBN = "created", b.ID, b.ISBN
+				created++
+			}
+		}
+		var invalid validationError
+		switch {
+		case err == nil:
+		case errors.As(err, &invalid):
+			result.Status, result.Message, result.Fields = "failed", "Book has invalid fields.", invalid
+		case errors.Is(err, errDuplicateISBN):
+			result.Status, result.Message = "failed", "A book with this ISBN already exists."
+		case errors.Is(err, errEventLogFailed):
+			result.Status, result.Message = "failed", "Could not write the change to the event log."
+		default:
+			result.Status, result.Message = "failed", "Could not create book."
+		}
+		results = append(results, result)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"created": created, "failed": len(rows) - created, "rows": results})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSVDownloadEscapesFormulasAndImportsBack(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := book{ID: "1", ISBN: "9780142437964", Title: `=HYPERLINK("https://example.org","x")`, Author: "@admin", Type: "general", Quantity: 1, Version: 1}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeCSV(c, "book-1", bookCSVHeader, [][]string{bookRow(b)})
+
+	body := w.Body.String()
+	if !strings.Contains(body, `"'=HYPERLINK(""https://example.org"",""x"")"`) || !strings.Contains(body, ",'@admin,") {
+		t.Fatalf("got %s, want the title and author prefixed with '", body)
+	}
+
+	rows, err := readCSVImport(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Err != nil || rows[0].Book.Title != b.Title || rows[0].Book.Author != b.Author {
+		t.Errorf("got %+v, want the title and author as they were", rows)
+	}
+}
@@ -2,11 +2,16 @@ module github.com/alaiy95/golang-projects/API1-Gin
 
 go 1.17
 
+require (
+	github.com/gin-gonic/gin v1.9.0
+	github.com/graphql-go/graphql v0.8.1
+	go.etcd.io/bbolt v1.3.7
+)
+
 require (
 	github.com/bytedance/sonic v1.8.6 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
-	github.com/gin-gonic/gin v1.9.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.12.0 // indirect
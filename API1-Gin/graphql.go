@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// principalContextKey is the key under which the GraphQL handler passes the caller to resolvers.
+type principalContextKey struct{}
+
+// A graphQLRequest is the body of POST /graphql, as sent by every GraphQL client.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// A graphQLError is an error reported to GraphQL clients with a machine-readable code in its extensions,
+// playing the part of the HTTP status code in the REST API. Fields holds per-field validation messages.
+type graphQLError struct {
+	message string
+	code    string
+	fields  map[string]string
+}
+
+func (e graphQLError) Error() string {
+	return e.message
+}
+
+func (e graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	if e.fields != nil {
+		ext["fields"] = e.fields
+	}
+	return ext
+}
+
+// toGraphQLError turns an error returned by the shared circulation and catalog functions into a graphQLError,
+// with the same messages the REST handlers send.
+func toGraphQLError(err error) error {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		return graphQLError{"Request has invalid fields.", "VALIDATION_FAILED", invalid}
+	case errors.Is(err, errMissingCopy):
+		return graphQLError{"Missing book or copy.", "BAD_REQUEST", nil}
+	case errors.Is(err, errMissingPatron):
+		return graphQLError{"Missing patron.", "BAD_REQUEST", nil}
+	case errors.Is(err, errNotYourPatron):
+		return graphQLError{"Patrons may only act on their own loans and holds.", "FORBIDDEN", nil}
+	case errors.Is(err, errFinesOutstanding):
+		return graphQLError{"Patron owes too much in fines to borrow.", "FINES_OUTSTANDING", nil}
+	case errors.Is(err, errLoanLimit):
+		return graphQLError{"Patron already has as many books as they may borrow.", "LOAN_LIMIT", nil}
+	case errors.Is(err, errLoanNotFound):
+		return graphQLError{"Loan not found.", "NOT_FOUND", nil}
+	case errors.Is(err, errLoanClosed):
+		return graphQLError{"Loan already returned.", "CONFLICT", nil}
+	case errors.Is(err, errDuplicateISBN):
+		return graphQLError{"A book with this ISBN already exists.", "CONFLICT", nil}
+	case errors.Is(err, errBranchNotFound):
+		return graphQLError{"Branch not found.", "NOT_FOUND", nil}
+	case errors.Is(err, errItemNotFound):
+		return graphQLError{"Copy not found.", "NOT_FOUND", nil}
+	case errors.Is(err, errWrongBranch):
+		return graphQLError{"This copy is held at another branch.", "CONFLICT", nil}
+	case errors.Is(err, errBookNotFound):
+		return graphQLError{"Book not found.", "NOT_FOUND", nil}
+	case errors.Is(err, errBookUnavailable):
+		return graphQLError{"Book not available.", "UNAVAILABLE", nil}
+	case errors.Is(err, errPreconditionFailed):
+		return graphQLError{"Book has changed since it was read.", "PRECONDITION_FAILED", nil}
+	case errors.Is(err, errVersionConflict):
+		return graphQLError{"Book is being modified by other requests, try again.", "CONFLICT", nil}
+	default:
+		return graphQLError{"Internal error.", "INTERNAL", nil}
+	}
+}
+
+// resolveCaller returns the caller the GraphQL request was made by.
+func resolveCaller(p graphql.ResolveParams) principal {
+	who, _ := p.Context.Value(principalContextKey{}).(principal)
+	return who
+}
+
+// stringArg returns a string argument, or "" if it was not given.
+func stringArg(p graphql.ResolveParams, name string) string {
+	s, _ := p.Args[name].(string)
+	return s
+}
+
+// stockLevelType, bookType, loanType and bookPageType mirror the JSON bodies of the REST API, field for field,
+// so the default resolvers can read them through their json tags.
+var stockLevelType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "StockLevel",
+	Fields: graphql.Fields{
+		"branch_id":  &graphql.Field{Type: graphql.String},
+		"book_id":    &graphql.Field{Type: graphql.String},
+		"available":  &graphql.Field{Type: graphql.Int},
+		"on_loan":    &graphql.Field{Type: graphql.Int},
+		"reserved":   &graphql.Field{Type: graphql.Int},
+		"in_transit": &graphql.Field{Type: graphql.Int},
+	},
+})
+
+var bookType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Book",
+	Fields: graphql.Fields{
+		"id":       &graphql.Field{Type: graphql.ID},
+		"isbn":     &graphql.Field{Type: graphql.String},
+		"title":    &graphql.Field{Type: graphql.String},
+		"author":   &graphql.Field{Type: graphql.String},
+		"type":     &graphql.Field{Type: graphql.String},
+		"quantity": &graphql.Field{Type: graphql.Int},
+		"version":  &graphql.Field{Type: graphql.Int},
+		"stock": &graphql.Field{
+			Type:        graphql.NewList(stockLevelType),
+			Description: "Copies of the book at each branch, as in GET /books/:id/stock.",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				b := p.Source.(book)
+				levels, err := countStock(func(it item) bool {
+					return it.BookID == b.ID
+				})
+				if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				return levels, nil
+			},
+		},
+	},
+})
+
+var loanType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Loan",
+	Fields: graphql.Fields{
+		"id":             &graphql.Field{Type: graphql.ID},
+		"book_id":        &graphql.Field{Type: graphql.String},
+		"item_barcode":   &graphql.Field{Type: graphql.String},
+		"branch_id":      &graphql.Field{Type: graphql.String},
+		"patron_id":      &graphql.Field{Type: graphql.String},
+		"checked_out_at": &graphql.Field{Type: graphql.DateTime},
+		"due_at":         &graphql.Field{Type: graphql.DateTime},
+		"renewals":       &graphql.Field{Type: graphql.Int},
+		"returned_at":    &graphql.Field{Type: graphql.DateTime},
+		"book": &graphql.Field{
+			Type:        bookType,
+			Description: "The book lent, or null if it has since been deleted.",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				b, err := store.Get(p.Source.(loan).BookID)
+				if errors.Is(err, errBookNotFound) {
+					return nil, nil
+				} else if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				return b, nil
+			},
+		},
+	},
+})
+
+var bookPageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "BookPage",
+	Fields: graphql.Fields{
+		"books":       &graphql.Field{Type: graphql.NewList(bookType)},
+		"total":       &graphql.Field{Type: graphql.Int},
+		"offset":      &graphql.Field{Type: graphql.Int},
+		"limit":       &graphql.Field{Type: graphql.Int},
+		"next_cursor": &graphql.Field{Type: graphql.String},
+	},
+})
+
+// checkoutResultType and returnResultType are what the checkout and returnBook mutations return,
+// the same as the bodies of PATCH /checkout and PATCH /return. Copies are left out; their barcodes are on the loan.
+var checkoutResultType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "CheckoutResult",
+	Fields: graphql.Fields{
+		"book": &graphql.Field{Type: bookType},
+		"loan": &graphql.Field{Type: loanType},
+	},
+})
+
+var returnResultType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "ReturnResult",
+	Fields: graphql.Fields{
+		"book":       &graphql.Field{Type: bookType},
+		"loan":       &graphql.Field{Type: loanType},
+		"hold_id":    &graphql.Field{Type: graphql.ID, Description: "The hold the copy was set aside for, if any."},
+		"fine_cents": &graphql.Field{Type: graphql.Int, Description: "The late fine charged, if any."},
+	},
+})
+
+// booksArgs are the arguments of the books query, named after the GET /books query parameters.
+var booksArgs = graphql.FieldConfigArgument{
+	"q":         &graphql.ArgumentConfig{Type: graphql.String},
+	"isbn":      &graphql.ArgumentConfig{Type: graphql.String},
+	"title":     &graphql.ArgumentConfig{Type: graphql.String},
+	"author":    &graphql.ArgumentConfig{Type: graphql.String},
+	"match":     &graphql.ArgumentConfig{Type: graphql.String},
+	"available": &graphql.ArgumentConfig{Type: graphql.Boolean},
+	"sort":      &graphql.ArgumentConfig{Type: graphql.String},
+	"limit":     &graphql.ArgumentConfig{Type: graphql.Int},
+	"offset":    &graphql.ArgumentConfig{Type: graphql.Int},
+	"cursor":    &graphql.ArgumentConfig{Type: graphql.String},
+}
+
+// resolveBooks searches the catalog exactly as GET /books does, by passing the arguments to readBookQuery.
+func resolveBooks(p graphql.ResolveParams) (interface{}, error) {
+	query, err := readBookQuery(func(key string) (string, bool) {
+		switch v := p.Args[key].(type) {
+		case string:
+			return v, true
+		case int:
+			return strconv.Itoa(v), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+		return "", false
+	})
+	if err != nil {
+		return nil, graphQLError{err.Error(), "BAD_REQUEST", nil}
+	}
+	books, err := store.List()
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return query.search(books), nil
+}
+
+// resolveLoans lists a patron's loans, as GET /patrons/:id/loans does. Patrons may only list their own.
+func resolveLoans(p graphql.ResolveParams) (interface{}, error) {
+	who := resolveCaller(p)
+	patron := stringArg(p, "patron")
+	if patron == "" {
+		patron = who.PatronID
+	}
+	if patron == "" {
+		return nil, toGraphQLError(errMissingPatron)
+	}
+	if !mayActFor(who, patron) {
+		return nil, toGraphQLError(errNotYourPatron)
+	}
+	openOnly, _ := p.Args["open"].(bool)
+	list, err := filterLoans(func(l loan) bool {
+		return l.PatronID == patron && (!openOnly || l.open())
+	})
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return list, nil
+}
+
+var queryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"books": &graphql.Field{
+			Type:        bookPageType,
+			Description: "Search, filter, sort and page the catalog, as GET /books.",
+			Args:        booksArgs,
+			Resolve:     resolveBooks,
+		},
+		"book": &graphql.Field{
+			Type: bookType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				b, err := store.Get(stringArg(p, "id"))
+				if errors.Is(err, errBookNotFound) {
+					return nil, nil
+				} else if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				return b, nil
+			},
+		},
+		"loans": &graphql.Field{
+			Type:        graphql.NewList(loanType),
+			Description: "A patron's loans; the caller's own if no patron is given.",
+			Args: graphql.FieldConfigArgument{
+				"patron": &graphql.ArgumentConfig{Type: graphql.String},
+				"open":   &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+			},
+			Resolve: resolveLoans,
+		},
+	},
+})
+
+var mutationType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"createBook": &graphql.Field{
+			Type:        bookType,
+			Description: "Add a book and its copies to the catalog, as POST /books. Librarians only.",
+			Args: graphql.FieldConfigArgument{
+				"isbn":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"title":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"author":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"type":     &graphql.ArgumentConfig{Type: graphql.String},
+				"quantity": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				who := resolveCaller(p)
+				if who.Role != roleLibrarian {
+					return nil, graphQLError{"Only librarians may do this.", "FORBIDDEN", nil}
+				}
+				quantity, _ := p.Args["quantity"].(int)
+				created, err := addBook(who, book{
+					ISBN:     stringArg(p, "isbn"),
+					Title:    stringArg(p, "title"),
+					Author:   stringArg(p, "author"),
+					Type:     stringArg(p, "type"),
+					Quantity: quantity,
+				})
+				if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				return created, nil
+			},
+		},
+		"checkout": &graphql.Field{
+			Type:        checkoutResultType,
+			Description: "Lend a copy to a patron, as PATCH /checkout. Give the book id, a copy's barcode or both.",
+			Args: graphql.FieldConfigArgument{
+				"id":      &graphql.ArgumentConfig{Type: graphql.ID},
+				"barcode": &graphql.ArgumentConfig{Type: graphql.String},
+				"patron":  &graphql.ArgumentConfig{Type: graphql.String},
+				"branch":  &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				who := resolveCaller(p)
+				req := checkoutRequest{
+					BookID:   stringArg(p, "id"),
+					Barcode:  stringArg(p, "barcode"),
+					PatronID: stringArg(p, "patron"),
+					BranchID: stringArg(p, "branch"),
+				}
+				if req.PatronID == "" {
+					req.PatronID = who.PatronID
+				}
+				b, _, l, err := checkout(who, req)
+				if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				return map[string]interface{}{"book": b, "loan": l}, nil
+			},
+		},
+		"returnBook": &graphql.Field{
+			Type:        returnResultType,
+			Description: "Close a loan and put the copy back into circulation, as PATCH /return. Give the loan id or the copy's barcode.",
+			Args: graphql.FieldConfigArgument{
+				"loan":      &graphql.ArgumentConfig{Type: graphql.ID},
+				"barcode":   &graphql.ArgumentConfig{Type: graphql.String},
+				"condition": &graphql.ArgumentConfig{Type: graphql.String},
+				"branch":    &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				b, l, reserved, fine, err := returnCopy(resolveCaller(p), returnRequest{
+					LoanID:    stringArg(p, "loan"),
+					Barcode:   stringArg(p, "barcode"),
+					Condition: stringArg(p, "condition"),
+					BranchID:  stringArg(p, "branch"),
+				})
+				if err != nil {
+					return nil, toGraphQLError(err)
+				}
+				result := map[string]interface{}{"book": b, "loan": l}
+				if reserved != nil {
+					result["hold_id"] = reserved.ID
+				}
+				if fine != nil {
+					result["fine_cents"] = fine.AmountCents
+				}
+				return result, nil
+			},
+		},
+	},
+})
+
+// graphQLSchema is built once at startup from the types above.
+var graphQLSchema = mustSchema(graphql.SchemaConfig{Query: queryType, Mutation: mutationType})
+
+func mustSchema(config graphql.SchemaConfig) graphql.Schema {
+	schema, err := graphql.NewSchema(config)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// serveGraphQL handles GET and POST /graphql. A POST carries a JSON graphQLRequest; a GET the query, operationName
+// and nothing else in the query string, and only queries are run for it. Errors are reported in the body with a 200 OK
+// status code, as GraphQL clients expect; only a body that cannot be read gets a 400 Bad Request.
+func serveGraphQL(c *gin.Context) {
+	var req graphQLRequest
+	if c.Request.Method == http.MethodPost {
+		if err := c.ShouldBindJSON(&req); err != nil || req.Query == "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON GraphQL request."})
+			return
+		}
+	} else {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if req.Query == "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing query query parameter."})
+			return
+		}
+	}
+	if c.Request.Method != http.MethodPost && hasMutation(req.Query, req.OperationName) {
+		// Mutations are refused on GET so that following a link cannot change anything.
+		c.IndentedJSON(http.StatusMethodNotAllowed, gin.H{"message": "Mutations must be sent with POST."})
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), principalContextKey{}, caller(c))
+	result := graphql.Do(graphql.Params{
+		Schema:         graphQLSchema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        ctx,
+	})
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// hasMutation reports whether the operation that would run for the document is a mutation. Documents that do not
+// parse are left for graphql.Do to report.
+func hasMutation(query, operationName string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName != "" && (op.Name == nil || op.Name.Value != operationName) {
+			continue
+		}
+		if op.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errHoldNotFound is returned by a HoldStore when no hold has the requested ID.
+var errHoldNotFound = errors.New("hold not found")
+
+// The states a hold moves through. A hold starts out waiting in its book's queue. When a copy comes back it becomes ready
+// and the copy is set aside for the holder until the pickup window runs out. It ends fulfilled, cancelled or expired.
+const (
+	holdWaiting   = "waiting"
+	holdReady     = "ready"
+	holdFulfilled = "fulfilled"
+	holdCancelled = "cancelled"
+	holdExpired   = "expired"
+)
+
+// A hold is a patron's place in the queue for a book that has no copies available.
+// Once the hold is ready, ItemBarcode is the copy set aside for the patron.
+type hold struct {
+	ID          string     `json:"id"`
+	BookID      string     `json:"book_id"`
+	PatronID    string     `json:"patron_id"`
+	Status      string     `json:"status"`
+	PlacedAt    time.Time  `json:"placed_at"`
+	ReadyAt     *time.Time `json:"ready_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ItemBarcode string     `json:"item_barcode,omitempty"`
+	LoanID      string     `json:"loan_id,omitempty"`
+}
+
+// active reports whether the hold is still in its book's queue.
+func (h hold) active() bool {
+	return h.Status == holdWaiting || h.Status == holdReady
+}
+
+// HoldStore is the persistence layer for holds, with the same memory and bolt backends as BookStore.
+type HoldStore interface {
+	// List returns every hold, in the order they were placed.
+	List() ([]hold, error)
+	// Get returns the hold with the given ID, or errHoldNotFound.
+	Get(id string) (hold, error)
+	// Create adds a new hold.
+	Create(h hold) error
+	// Update overwrites an existing hold, or returns errHoldNotFound.
+	Update(h hold) error
+}
+
+// holds holds every hold placed through /books/:id/holds. It is chosen in main alongside store.
+var holds HoldStore
+
+// pickupWindow is how long a copy stays reserved for a ready hold. It is set in main with the -pickup-window flag.
+var pickupWindow = 72 * time.Hour
+
+// memoryHoldStore keeps holds in a map, so they are lost when the process exits.
+type memoryHoldStore struct {
+	mu    sync.RWMutex
+	holds map[string]hold
+}
+
+func newMemoryHoldStore() *memoryHoldStore {
+	return &memoryHoldStore{holds: map[string]hold{}}
+}
+
+func (s *memoryHoldStore) List() ([]hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]hold, 0, len(s.holds))
+	for _, h := range s.holds {
+		list = append(list, h)
+	}
+	sortHolds(list)
+	return list, nil
+}
+
+func (s *memoryHoldStore) Get(id string) (hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.holds[id]
+	if !ok {
+		return hold{}, errHoldNotFound
+	}
+	return h, nil
+}
+
+func (s *memoryHoldStore) Create(h hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holds[h.ID] = h
+	return nil
+}
+
+func (s *memoryHoldStore) Update(h hold) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.holds[h.ID]; !ok {
+		return errHoldNotFound
+	}
+	s.holds[h.ID] = h
+	return nil
+}
+
+// sortHolds orders holds by the time they were placed, so the first waiting hold for a book is the head of its queue.
+func sortHolds(list []hold) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].PlacedAt.Before(list[j].PlacedAt)
+	})
+}
+
+// filterHolds returns the holds for which keep returns true, in queue order.
+func filterHolds(keep func(hold) bool) ([]hold, error) {
+	all, err := holds.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []hold{}
+	for _, h := range all {
+		if keep(h) {
+			list = append(list, h)
+		}
+	}
+	return list, nil
+}
+
+// releaseCopy puts a copy back into circulation. If patrons are waiting for its book, the copy is reserved
+// for the first of them instead of going back on the shelf, and that hold is returned.
+// it is the copy to save, which may have a new condition or branch; before is the copy as it is stored now.
+// It also returns the book and the copy as saved. ifMatch is checked against the book as in updateBook.
+// How to reverse each write is added to undo, and a failed call leaves undo ready to roll back.
+// The caller must hold circulationMu.
+func releaseCopy(before, it item, ifMatch string, undo *undoLog) (book, item, *hold, error) {
+	waiting, err := filterHolds(func(h hold) bool {
+		return h.BookID == it.BookID && h.Status == holdWaiting
+	})
+	if err != nil {
+		return book{}, item{}, nil, err
+	}
+	if len(waiting) == 0 {
+		b, err := updateBook(it.BookID, ifMatch, func(b *book) error {
+			b.Quantity += 1
+			return nil
+		})
+		if err != nil {
+			return book{}, item{}, nil, err
+		}
+		undo.add(undoBookUpdate(b.ID, 1))
+		it.Status = itemAvailable
+		if err := items.Update(it); err != nil {
+			return book{}, item{}, nil, err
+		}
+		undo.add(undoItemUpdate(before))
+		return b, it, nil, nil
+	}
+
+	b, err := store.Get(it.BookID)
+	if err != nil {
+		return book{}, item{}, nil, err
+	}
+	if !etagMatches(ifMatch, b) {
+		return book{}, item{}, nil, errPreconditionFailed
+	}
+	next := waiting[0]
+	waitingHold := next
+	now := time.Now().UTC()
+	expires := now.Add(pickupWindow)
+	next.Status = holdReady
+	next.ReadyAt = &now
+	next.ExpiresAt = &expires
+	next.ItemBarcode = it.Barcode
+	if err := holds.Update(next); err != nil {
+		return book{}, item{}, nil, err
+	}
+	undo.add(func() error { return holds.Update(waitingHold) })
+	it.Status = itemReserved
+	if err := items.Update(it); err != nil {
+		return book{}, item{}, nil, err
+	}
+	undo.add(undoItemUpdate(before))
+	return b, it, &next, nil
+}
+
+// endReadyHold saves h, a ready hold that has just been cancelled or has expired, and passes on the copy that was set aside for it.
+// Both are saved before anything is logged: the hold's event of type eventType, then where the copy went. If a write fails,
+// the hold is put back as ready and the copy as reserved. The caller must hold circulationMu.
+func endReadyHold(actor string, h hold, eventType string) error {
+	ready := h
+	ready.Status = holdReady
+	it, err := items.Get(h.ItemBarcode)
+	if err != nil {
+		return err
+	}
+	var undo undoLog
+	if err := holds.Update(h); err != nil {
+		return err
+	}
+	undo.add(func() error { return holds.Update(ready) })
+	b, it, next, err := releaseCopy(it, it, "", &undo)
+	if err != nil {
+		undo.rollback()
+		return err
+	}
+	if _, err := appendEvent(actor, event{Type: eventType, Hold: &h}); err != nil {
+		undo.rollback()
+		return err
+	}
+	released, err := appendEvent(actor, event{Type: eventCopyReleased, Book: &b, Item: &it, Hold: next})
+	if err != nil {
+		undo.rollback()
+		return err
+	}
+	notifyIfBackInStock(released)
+	return nil
+}
+
+// expireHolds ends every ready hold whose pickup window has run out and passes its copy on to the next holder,
+// or back into general circulation.
+func expireHolds() error {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	now := time.Now().UTC()
+	expired, err := filterHolds(func(h hold) bool {
+		return h.Status == holdReady && h.ExpiresAt != nil && now.After(*h.ExpiresAt)
+	})
+	if err != nil {
+		return err
+	}
+	for _, h := range expired {
+		h.Status = holdExpired
+		if err := endReadyHold("", h, eventHoldExpired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireHoldsEvery runs expireHolds on a timer until ctx is cancelled.
+func expireHoldsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := expireHolds(); err != nil {
+			log.Printf("Error expiring holds: %v", err)
+		}
+	}
+}
+
+// respondHolds writes the holds matching keep as JSON.
+func respondHolds(c *gin.Context, keep func(hold) bool) {
+	list, err := filterHolds(keep)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list holds."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// bookHolds handles GET /books/:id/holds and lists the book's queue: the waiting and ready holds in the order they were placed.
+func bookHolds(c *gin.Context) {
+	bookID := c.Param("id")
+	respondHolds(c, func(h hold) bool {
+		return h.BookID == bookID && h.active()
+	})
+}
+
+// patronHolds handles GET /patrons/:id/holds and lists every hold the patron has placed.
+func patronHolds(c *gin.Context) {
+	patron := c.Param("id")
+	respondHolds(c, func(h hold) bool {
+		return h.PatronID == patron
+	})
+}
+
+// placeHold handles POST /books/:id/holds?patron=... and adds the patron to the end of the book's queue.
+// The patron defaults to the caller, and patrons may only place holds for themselves.
+// Holds can only be placed on books that have no copies available.
+func placeHold(c *gin.Context) {
+	patron := c.Query("patron")
+	if patron == "" {
+		patron = caller(c).PatronID
+	}
+	if patron == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing patron query parameter."})
+		return
+	}
+	if !allowedPatron(c, patron) {
+		return
+	}
+
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	book, err := getBookById(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
+		return
+	}
+	if book.Quantity > 0 {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Book is available, check it out instead."})
+		return
+	}
+
+	existing, err := filterHolds(func(h hold) bool {
+		return h.BookID == book.ID && h.PatronID == patron && h.active()
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list holds."})
+		return
+	}
+	if len(existing) > 0 {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Patron already has a hold on this book."})
+		return
+	}
+
+	newHold := hold{
+		ID:       newID(),
+		BookID:   book.ID,
+		PatronID: patron,
+		Status:   holdWaiting,
+		PlacedAt: time.Now().UTC(),
+	}
+	if err := holds.Create(newHold); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not place hold."})
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventHoldPlaced, Hold: &newHold}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, newHold)
+}
+
+// cancelHold handles DELETE /holds/:id. Cancelling a ready hold passes its reserved copy on to the next holder.
+func cancelHold(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	h, err := holds.Get(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Hold not found."})
+		return
+	}
+	if !allowedPatron(c, h.PatronID) {
+		return
+	}
+	if !h.active() {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Hold is already " + h.Status + "."})
+		return
+	}
+
+	// A ready hold has a copy set aside, which is passed on with it.
+	if h.Status == holdReady {
+		h.Status = holdCancelled
+		if err := endReadyHold(caller(c).Name, h, eventHoldCancelled); err != nil {
+			respondCirculationError(c, err, h.PatronID)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, h)
+		return
+	}
+	h.Status = holdCancelled
+	if err := holds.Update(h); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not cancel hold."})
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventHoldCancelled, Hold: &h}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, h)
+}
+
+// fulfilHold handles PATCH /holds/:id/fulfil. The holder picks up the reserved copy, which is lent to them as a normal loan.
+func fulfilHold(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	h, err := holds.Get(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Hold not found."})
+		return
+	}
+	if !allowedPatron(c, h.PatronID) {
+		return
+	}
+	now := time.Now().UTC()
+	if h.Status != holdReady || now.After(*h.ExpiresAt) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Hold is not ready for pickup."})
+		return
+	}
+	if !checkBorrowing(c, h.PatronID) {
+		return
+	}
+
+	// The reserved copy was never put back on the shelf, so the book's Quantity does not change.
+	it, err := items.Get(h.ItemBarcode)
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	b, err := store.Get(h.BookID)
+	if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	newLoan := loan{
+		ID:           newID(),
+		BookID:       h.BookID,
+		ItemBarcode:  it.Barcode,
+		BranchID:     it.BranchID,
+		PatronID:     h.PatronID,
+		CheckedOutAt: now,
+		DueAt:        now.Add(patronLoanPeriod(h.PatronID)),
+	}
+	var undo undoLog
+	if err := loans.Create(newLoan); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not record loan."})
+		return
+	}
+	undo.add(func() error { return loans.Delete(newLoan.ID) })
+	reserved := it
+	it.Status = itemOnLoan
+	if err := items.Update(it); err != nil {
+		undo.rollback()
+		respondItemError(c, err)
+		return
+	}
+	undo.add(undoItemUpdate(reserved))
+	ready := h
+	h.Status = holdFulfilled
+	h.LoanID = newLoan.ID
+	if err := holds.Update(h); err != nil {
+		undo.rollback()
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not update hold."})
+		return
+	}
+	undo.add(func() error { return holds.Update(ready) })
+	fulfilled, err := recordEvent(c, event{Type: eventHoldFulfilled, Hold: &h, Loan: &newLoan, Item: &it})
+	if err != nil {
+		undo.rollback()
+		respondEventLogError(c)
+		return
+	}
+	// To webhooks a pickup is a checkout like one made at the desk, with the same book, copy and loan.
+	checkedOut := fulfilled
+	checkedOut.Type = eventCheckedOut
+	checkedOut.Book = &b
+	checkedOut.Hold = nil
+	notifyWebhooks(checkedOut)
+	c.IndentedJSON(http.StatusOK, gin.H{"hold": h, "loan": newLoan})
+}
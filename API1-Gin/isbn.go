@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// normalizeISBN checks an ISBN-10 or ISBN-13 and returns it as 13 digits without separators.
+// Hyphens and spaces are ignored, and the final character of an ISBN-10 may be X.
+func normalizeISBN(s string) (string, error) {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(s)))
+	switch len(digits) {
+	case 10:
+		if !validISBN10(digits) {
+			return "", errors.New("is not a valid ISBN-10")
+		}
+		isbn := "978" + digits[:9]
+		return isbn + string(isbn13CheckDigit(isbn)), nil
+	case 13:
+		if !allDigits(digits) {
+			return "", errors.New("must contain only digits")
+		}
+		if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", errors.New("must start with 978 or 979")
+		}
+		if isbn13CheckDigit(digits[:12]) != digits[12] {
+			return "", errors.New("has an invalid check digit")
+		}
+		return digits, nil
+	default:
+		return "", errors.New("must be an ISBN-10 or ISBN-13")
+	}
+}
+
+// validISBN10 checks the mod-11 checksum of a 10 character ISBN.
+func validISBN10(s string) bool {
+	sum := 0
+	for i := 0; i < 10; i++ {
+		var d int
+		switch {
+		case s[i] >= '0' && s[i] <= '9':
+			d = int(s[i] - '0')
+		case s[i] == 'X' && i == 9:
+			d = 10
+		default:
+			return false
+		}
+		sum += d * (10 - i)
+	}
+	return sum%11 == 0
+}
+
+// isbn13CheckDigit returns the check digit for the first 12 digits of an ISBN-13.
+func isbn13CheckDigit(first12 string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(first12[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errItemNotFound is returned by an ItemStore when no copy has the requested barcode.
+var errItemNotFound = errors.New("item not found")
+
+// errItemExists is returned by an ItemStore when a copy is added with a barcode that is already taken.
+var errItemExists = errors.New("item already exists")
+
+// The states of a physical copy. Only available copies are counted in their book's Quantity.
+const (
+	itemAvailable = "available"
+	itemOnLoan    = "on_loan"
+	itemReserved  = "reserved"
+	itemInTransit = "in_transit"
+	itemWithdrawn = "withdrawn"
+)
+
+// itemConditions lists the conditions a copy can be recorded in, best first.
+var itemConditions = []string{"new", "good", "fair", "poor", "damaged"}
+
+// An item is one physical copy of a book, identified by the barcode stuck on it, and held at a branch.
+type item struct {
+	Barcode   string    `json:"barcode"`
+	BookID    string    `json:"book_id"`
+	BranchID  string    `json:"branch_id"`
+	Condition string    `json:"condition"`
+	Status    string    `json:"status"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// ItemStore is the persistence layer for copies, with the same memory and bolt backends as BookStore.
+type ItemStore interface {
+	// List returns every copy, in the order they were added.
+	List() ([]item, error)
+	// Get returns the copy with the given barcode, or errItemNotFound.
+	Get(barcode string) (item, error)
+	// Create adds a new copy, or returns errItemExists if the barcode is already taken.
+	Create(it item) error
+	// Update overwrites an existing copy, or returns errItemNotFound.
+	Update(it item) error
+	// Delete removes a copy, or returns errItemNotFound.
+	Delete(barcode string) error
+}
+
+// items holds every copy of every book. It is chosen in main alongside store.
+var items ItemStore
+
+// memoryItemStore keeps copies in a map, so they are lost when the process exits.
+type memoryItemStore struct {
+	mu    sync.RWMutex
+	items map[string]item
+}
+
+func newMemoryItemStore() *memoryItemStore {
+	return &memoryItemStore{items: map[string]item{}}
+}
+
+func (s *memoryItemStore) List() ([]item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]item, 0, len(s.items))
+	for _, it := range s.items {
+		list = append(list, it)
+	}
+	sortItems(list)
+	return list, nil
+}
+
+func (s *memoryItemStore) Get(barcode string) (item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it, ok := s.items[barcode]
+	if !ok {
+		return item{}, errItemNotFound
+	}
+	return it, nil
+}
+
+func (s *memoryItemStore) Create(it item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[it.Barcode]; ok {
+		return errItemExists
+	}
+	s.items[it.Barcode] = it
+	return nil
+}
+
+func (s *memoryItemStore) Update(it item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[it.Barcode]; !ok {
+		return errItemNotFound
+	}
+	s.items[it.Barcode] = it
+	return nil
+}
+
+func (s *memoryItemStore) Delete(barcode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[barcode]; !ok {
+		return errItemNotFound
+	}
+	delete(s.items, barcode)
+	return nil
+}
+
+// sortItems orders copies by the time they were added, then by barcode.
+func sortItems(list []item) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].AddedAt.Equal(list[j].AddedAt) {
+			return list[i].AddedAt.Before(list[j].AddedAt)
+		}
+		return list[i].Barcode < list[j].Barcode
+	})
+}
+
+// filterItems returns the copies for which keep returns true.
+func filterItems(keep func(item) bool) ([]item, error) {
+	all, err := items.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []item{}
+	for _, it := range all {
+		if keep(it) {
+			list = append(list, it)
+		}
+	}
+	return list, nil
+}
+
+// validCondition reports whether s is one of itemConditions.
+func validCondition(s string) bool {
+	for _, c := range itemConditions {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// newBarcode returns a generated barcode for a copy that was added without one.
+func newBarcode() string {
+	return "C" + strings.ToUpper(newID())
+}
+
+// addCopies creates n available copies of a book at a branch in the given condition. It does not change the book's Quantity.
+func addCopies(bookID, branchID string, n int, condition string) ([]item, error) {
+	added := []item{}
+	now := time.Now().UTC()
+	for i := 0; i < n; i++ {
+		it := item{Barcode: newBarcode(), BookID: bookID, BranchID: branchID, Condition: condition, Status: itemAvailable, AddedAt: now}
+		if err := items.Create(it); err != nil {
+			return added, err
+		}
+		added = append(added, it)
+	}
+	return added, nil
+}
+
+// availableItem returns the first copy of a book that is on the shelf at the branch, or at any branch if branchID is empty.
+// It returns errBookUnavailable if there is none.
+func availableItem(bookID, branchID string) (item, error) {
+	shelf, err := filterItems(func(it item) bool {
+		return it.BookID == bookID && it.Status == itemAvailable && (branchID == "" || it.BranchID == branchID)
+	})
+	if err != nil {
+		return item{}, err
+	}
+	if len(shelf) == 0 {
+		return item{}, errBookUnavailable
+	}
+	return shelf[0], nil
+}
+
+// backfillItems gives every book that has no copies on record as many available copies as its Quantity,
+// so catalogs saved before copies were tracked keep their stock. The new copies are written to the event log.
+func backfillItems() error {
+	books, err := store.List()
+	if err != nil {
+		return err
+	}
+	all, err := items.List()
+	if err != nil {
+		return err
+	}
+	tracked := map[string]bool{}
+	for _, it := range all {
+		tracked[it.BookID] = true
+	}
+	for _, b := range books {
+		if tracked[b.ID] || b.Quantity <= 0 {
+			continue
+		}
+		added, err := addCopies(b.ID, defaultBranchID, b.Quantity, "good")
+		if err != nil {
+			return err
+		}
+		for i := range added {
+			if _, err := appendEvent("", event{Type: eventItemAdded, Item: &added[i]}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// respondItemError writes the HTTP response for an error returned by the item store.
+func respondItemError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errItemNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Copy not found."})
+	case errors.Is(err, errItemExists):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "A copy with this barcode already exists."})
+	case errors.Is(err, errWrongBranch):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "This copy is held at another branch."})
+	case errors.Is(err, errBranchNotFound):
+		respondBranchError(c, err)
+	default:
+		respondBookError(c, err)
+	}
+}
+
+// bookItems handles GET /books/:id/items and lists every copy of the book, including withdrawn ones.
+func bookItems(c *gin.Context) {
+	bookID := c.Param("id")
+	if _, err := store.Get(bookID); err != nil {
+		respondBookError(c, err)
+		return
+	}
+	list, err := filterItems(func(it item) bool {
+		return it.BookID == bookID
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list copies."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getItem handles GET /items/:barcode.
+func getItem(c *gin.Context) {
+	it, err := items.Get(c.Param("barcode"))
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, it)
+}
+
+// itemInput is the body accepted when adding or updating a copy. The branch is only used when adding;
+// copies move between branches through transfers.
+type itemInput struct {
+	Barcode   string `json:"barcode"`
+	BranchID  string `json:"branch_id"`
+	Condition string `json:"condition"`
+}
+
+// addItem handles POST /books/:id/items and puts a new copy of the book on the shelf.
+// The barcode is generated if the body does not give one, the branch defaults to the default branch and the condition to new.
+func addItem(c *gin.Context) {
+	var input itemInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON copy."})
+		return
+	}
+	if input.Condition == "" {
+		input.Condition = "new"
+	}
+	if !validCondition(input.Condition) {
+		respondValidationErrors(c, map[string]string{"condition": "must be one of " + strings.Join(itemConditions, ", ")})
+		return
+	}
+	input.Barcode = strings.TrimSpace(input.Barcode)
+	if input.Barcode == "" {
+		input.Barcode = newBarcode()
+	}
+	if input.BranchID == "" {
+		input.BranchID = defaultBranchID
+	}
+
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	if _, err := branches.Get(input.BranchID); errors.Is(err, errBranchNotFound) {
+		respondValidationErrors(c, map[string]string{"branch_id": "must be an existing branch"})
+		return
+	} else if err != nil {
+		respondBranchError(c, err)
+		return
+	}
+
+	bookID := c.Param("id")
+	if _, err := store.Get(bookID); err != nil {
+		respondBookError(c, err)
+		return
+	}
+	it := item{Barcode: input.Barcode, BookID: bookID, BranchID: input.BranchID, Condition: input.Condition, Status: itemAvailable, AddedAt: time.Now().UTC()}
+	var undo undoLog
+	if err := items.Create(it); err != nil {
+		respondItemError(c, err)
+		return
+	}
+	undo.add(func() error { return items.Delete(it.Barcode) })
+	b, err := updateBook(bookID, "", func(b *book) error {
+		b.Quantity += 1
+		return nil
+	})
+	if err != nil {
+		undo.rollback()
+		respondBookError(c, err)
+		return
+	}
+	undo.add(undoBookUpdate(b.ID, 1))
+	added, err := recordEvent(c, event{Type: eventItemAdded, Book: &b, Item: &it})
+	if err != nil {
+		undo.rollback()
+		respondEventLogError(c)
+		return
+	}
+	notifyIfBackInStock(added)
+	setBookETag(c, b)
+	c.IndentedJSON(http.StatusCreated, gin.H{"book": b, "item": it})
+}
+
+// updateItem handles PATCH /items/:barcode and records a new condition for the copy.
+func updateItem(c *gin.Context) {
+	var input itemInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON copy."})
+		return
+	}
+	if !validCondition(input.Condition) {
+		respondValidationErrors(c, map[string]string{"condition": "must be one of " + strings.Join(itemConditions, ", ")})
+		return
+	}
+
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	it, err := items.Get(c.Param("barcode"))
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	it.Condition = input.Condition
+	if err := items.Update(it); err != nil {
+		respondItemError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventItemUpdated, Item: &it}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, it)
+}
+
+// withdrawItem handles DELETE /items/:barcode and takes a copy that is on the shelf out of circulation.
+// The copy is kept on record with the withdrawn status.
+func withdrawItem(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	it, err := items.Get(c.Param("barcode"))
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	if it.Status != itemAvailable {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Only copies on the shelf can be withdrawn, this one is " + it.Status + "."})
+		return
+	}
+	var undo undoLog
+	before := it
+	it.Status = itemWithdrawn
+	if err := items.Update(it); err != nil {
+		respondItemError(c, err)
+		return
+	}
+	undo.add(undoItemUpdate(before))
+	b, err := updateBook(it.BookID, "", func(b *book) error {
+		b.Quantity -= 1
+		return nil
+	})
+	if err != nil {
+		undo.rollback()
+		respondBookError(c, err)
+		return
+	}
+	undo.add(undoBookUpdate(b.ID, -1))
+	if _, err := recordEvent(c, event{Type: eventItemWithdrawn, Book: &b, Item: &it}); err != nil {
+		undo.rollback()
+		respondEventLogError(c)
+		return
+	}
+	setBookETag(c, b)
+	c.IndentedJSON(http.StatusOK, gin.H{"book": b, "item": it})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errLoanNotFound is returned by a LoanStore when no loan has the requested ID.
+var errLoanNotFound = errors.New("loan not found")
+
+// A loan records that a patron has a copy of a book. It is open until ReturnedAt is set.
+// ItemBarcode is empty for loans made before copies were tracked individually, and BranchID for loans made before there were branches.
+type loan struct {
+	ID           string     `json:"id"`
+	BookID       string     `json:"book_id"`
+	ItemBarcode  string     `json:"item_barcode,omitempty"`
+	BranchID     string     `json:"branch_id,omitempty"`
+	PatronID     string     `json:"patron_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at"`
+	Renewals     int        `json:"renewals"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty"`
+}
+
+// open reports whether the copy is still with the patron.
+func (l loan) open() bool {
+	return l.ReturnedAt == nil
+}
+
+// overdue reports whether the loan is open past its due date.
+func (l loan) overdue(now time.Time) bool {
+	return l.open() && now.After(l.DueAt)
+}
+
+// LoanStore is the persistence layer for loans, with the same memory and bolt backends as BookStore.
+type LoanStore interface {
+	// List returns every loan, open or closed, oldest first.
+	List() ([]loan, error)
+	// Get returns the loan with the given ID, or errLoanNotFound.
+	Get(id string) (loan, error)
+	// Create adds a new loan.
+	Create(l loan) error
+	// Update overwrites an existing loan, or returns errLoanNotFound.
+	Update(l loan) error
+	// Delete removes a loan. Loans are kept for good; this only rolls back a checkout that failed halfway (see undo.go).
+	Delete(id string) error
+}
+
+// loans holds every loan made through /checkout. It is chosen in main alongside store.
+var loans LoanStore
+
+// loanPeriod is how long a patron may keep a book unless the borrowing policy says otherwise. It is set in main with the -loan-days flag.
+var loanPeriod = 14 * 24 * time.Hour
+
+// newID returns a random 16 character hex string for use as a record ID.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// memoryLoanStore keeps loans in a map, so they are lost when the process exits.
+type memoryLoanStore struct {
+	mu    sync.RWMutex
+	loans map[string]loan
+}
+
+func newMemoryLoanStore() *memoryLoanStore {
+	return &memoryLoanStore{loans: map[string]loan{}}
+}
+
+func (s *memoryLoanStore) List() ([]loan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]loan, 0, len(s.loans))
+	for _, l := range s.loans {
+		list = append(list, l)
+	}
+	sortLoans(list)
+	return list, nil
+}
+
+func (s *memoryLoanStore) Get(id string) (loan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.loans[id]
+	if !ok {
+		return loan{}, errLoanNotFound
+	}
+	return l, nil
+}
+
+func (s *memoryLoanStore) Create(l loan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loans[l.ID] = l
+	return nil
+}
+
+func (s *memoryLoanStore) Update(l loan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.loans[l.ID]; !ok {
+		return errLoanNotFound
+	}
+	s.loans[l.ID] = l
+	return nil
+}
+
+func (s *memoryLoanStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loans, id)
+	return nil
+}
+
+// sortLoans orders loans by checkout time, oldest first.
+func sortLoans(list []loan) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CheckedOutAt.Before(list[j].CheckedOutAt)
+	})
+}
+
+// filterLoans returns the loans for which keep returns true.
+func filterLoans(keep func(loan) bool) ([]loan, error) {
+	all, err := loans.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []loan{}
+	for _, l := range all {
+		if keep(l) {
+			list = append(list, l)
+		}
+	}
+	return list, nil
+}
+
+// respondLoans writes the loans matching keep as JSON.
+func respondLoans(c *gin.Context, keep func(loan) bool) {
+	list, err := filterLoans(keep)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list loans."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// patronLoans handles GET /patrons/:id/loans and lists every loan, open or returned, made by the patron.
+func patronLoans(c *gin.Context) {
+	patron := c.Param("id")
+	respondLoans(c, func(l loan) bool {
+		return l.PatronID == patron
+	})
+}
+
+// openLoans handles GET /loans and lists every loan that has not been returned yet.
+func openLoans(c *gin.Context) {
+	respondLoans(c, loan.open)
+}
+
+// overdueLoans handles GET /loans/overdue and lists every open loan that is past its due date.
+func overdueLoans(c *gin.Context) {
+	now := time.Now().UTC()
+	respondLoans(c, func(l loan) bool {
+		return l.overdue(now)
+	})
+}
@@ -1,161 +1,802 @@
-// This program provides a simple API for a book library that allows users to get a list of books,
-// get a specific book by ID, check out a book, return a book, and create a new book.
-
-package main
-
-// First, the necessary packages are imported: "net/http" for HTTP protocol, "errors" for handling errors, and "github.com/gin-gonic/gin" for the Gin web framework.
-import (
-	"net/http"
-
-	"errors"
-
-	"github.com/gin-gonic/gin"
-)
-
-// Next, a struct book is defined to represent a book with its properties like ID, Title, Author, and Quantity.
-type book struct {
-	ID       string `json:"id"`
-	Title    string `json:"title"`
-	Author   string `json:"author"`
-	Quantity int    `json:"quantity"`
-}
-
-// This is a slice of book structs that serves as a simple database of books for this book management system.
-var books = []book{
-	{ID: "1", Title: "In Search of Lost Time", Author: "Marcel Proust", Quantity: 2},
-	{ID: "2", Title: "The Great Gatsby", Author: "F. Scott Fitzgerald", Quantity: 5},
-	{ID: "3", Title: "War and Peace", Author: "Leo Tolstoy", Quantity: 6},
-}
-
-// Functions are defined to perform CRUD operations on the books.
-
-// The getBooks function handles requests to the /books endpoint and returns a list of all books in the library as JSON.
-// getBooks retrieves all the books from the slice of books and returns them in JSON format.
-func getBooks(c *gin.Context) {
-	c.IndentedJSON(http.StatusOK, books)
-}
-
-// bookById functionHandles requests to '/books/id/ and retrieves a single book by its ID.
-// It calls the function to retrieve the book with the specified ID,
-// and returns the book or an error message in JSON format.
-func bookById(c *gin.Context) {
-	id := c.Param("id")
-	book, err := getBookById(id)
-	// If the book is not found, it returns a 404 Not Found status code.
-	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
-		return
-	}
-
-	c.IndentedJSON(http.StatusOK, book)
-}
-
-// The checkoutBook function is a handler for the HTTP PATCH method on the "/checkout" endpoint.
-func checkoutBook(c *gin.Context) {
-	// Extract the "id" query parameter from the HTTP request.
-	id, ok := c.GetQuery("id")
-
-	// If the "id" query parameter is not present, return a HTTP response with a 400 Bad Request status code ana JSON Object with the error.
-	if !ok {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing id query parameter."})
-		return
-	}
-	// Get the book from the "books" slice with the given "id" using the `getBookById` function.
-	book, err := getBookById(id)
-
-	// If the book is not found in the "books" slice, return a HTTP response with a 404 Not Found status code.
-	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
-		return
-	}
-
-	// If the book is found but its quantity is already zero, return a HTTP response with a 400 Bad Request status code.
-	if book.Quantity <= 0 {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Book not available."})
-		return
-	}
-
-	// Decrement the quantity of the book by one and return a HTTP response with a 200 OK status code and the book object as a JSON response.
-	book.Quantity -= 1
-	c.IndentedJSON(http.StatusOK, book)
-}
-
-// The returnBook function handles requests to the /return endpoint and allows a user to return a book to the library.
-// returnBook function is used to handle the PATCH request to return a book. It takes a gin.Context object as its only parameter
-func returnBook(c *gin.Context) {
-
-	// check if the id query parameter is present in the request URL by calling the GetQuery method of the gin.Context object.
-	id, ok := c.GetQuery("id")
-
-	// If the id parameter is not present, the function returns a 400 Bad Request status code with a JSON message indicating that the id parameter is missing.
-	if !ok {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing id query parameter."})
-		return
-	}
-
-	// If the id parameter is present, the function calls the getBookById function to retrieve the book with the specified ID.
-	book, err := getBookById(id)
-
-	// If the book is not found, the function returns a 404 Not Found status code with a JSON message indicating that the book was not found.
-	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
-		return
-	}
-
-	// If the book is found, the function increments the Quantity field of the book object by 1
-	book.Quantity += 1
-
-	// and returns a 200 OK status code with the updated book object in the response body as a JSON object.
-	c.IndentedJSON(http.StatusOK, book)
-}
-
-// getBookById is a helper function that takes an ID string and returns a pointer to a book struct and an error.
-// It loops through the global books slice, checks if the book with the given ID exists, and returns a pointer to that book if it does.
-// If the book is not found, it returns a nil pointer and an error message.
-func getBookById(id string) (*book, error) {
-	// Loop through the global books slice
-	for i, b := range books {
-		// Check if the ID of the current book in the loop matches the given ID
-		if b.ID == id {
-			// Return a pointer to the current book in the loop and no error
-			return &books[i], nil
-		}
-	}
-	// If the function reaches this point, the book was not found, so return a nil pointer and an error message
-	return nil, errors.New("book not found")
-}
-
-// The createBook function handles requests to the /books endpoint with a POST request method
-// and allows a user to create a new book by sending a JSON object in the request body. The function parses the
-func createBook(c *gin.Context) {
-	var newBook book
-
-	// Bind the request body JSON data to the newBook variable
-	// If an error occurs while binding, return early from the function
-	if err := c.BindJSON(&newBook); err != nil {
-		return
-	}
-
-	// Append the new book to the books slice
-	books = append(books, newBook)
-
-	// Respond with a JSON representation of the new book and a 201 Created status code
-	c.IndentedJSON(http.StatusCreated, newBook)
-}
-
-// The router object sets up the routing for the API by defining the endpoints for each of the above functions and starting the server on port 8080.
-
-// A PATCH request is an HTTP method that is used to partially update a resource on the server.
-// It is similar to the HTTP PUT method, which is used to completely replace a resource on the server.
-// However, the PATCH method allows for more fine-grained updates of a resource by specifying only the fields that need to be updated,
-// instead of sending the entire resource with all its fields.
-// The PATCH request can be used in situations where updating a whole resource is unnecessary or undesirable.
-func main() {
-	router := gin.Default()
-	router.GET("/books", getBooks)
-	router.GET("/books/:id", bookById)
-	router.POST("/books", createBook)
-	router.PATCH("/checkout", checkoutBook)
-	router.PATCH("/return", returnBook)
-	router.Run("localhost:8080")
-}
+// This program provides a simple API for a book library that allows users to get a list of books,
+// get a specific book by ID, check out a book, return a book, and create a new book.
+
+package main
+
+// First, the necessary packages are imported: "net/http" for HTTP protocol, "errors" for handling errors, and "github.com/gin-gonic/gin" for the Gin web framework.
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Next, a struct book is defined to represent a book with its properties like ID, ISBN, Title, Author, Type and Quantity.
+// The ISBN is always stored in its 13-digit form (see isbn.go). Type groups books for the fines policy (see fines.go). Quantity is the number of copies on the shelf;
+// it is kept up to date by the server as copies are lent, returned, added and withdrawn (see items.go).
+// Version is bumped by the store on every change and is sent to clients as the ETag (see etag.go).
+// The xml tags give the element names used when books are sent as XML (see formats.go).
+type book struct {
+	ID       string `json:"id" xml:"id"`
+	ISBN     string `json:"isbn" xml:"isbn"`
+	Title    string `json:"title" xml:"title"`
+	Author   string `json:"author" xml:"author"`
+	Type     string `json:"type" xml:"type"`
+	Quantity int    `json:"quantity" xml:"quantity"`
+	Version  int    `json:"version" xml:"version"`
+}
+
+// store is the catalog used by every handler. It is chosen in main with the -store flag (see store.go and bolt.go).
+var store BookStore
+
+// Functions are defined to perform CRUD operations on the books.
+
+// The getBooks function handles requests to the /books endpoint and returns a page of the books in the library as JSON.
+// getBooks retrieves the books from the store, then searches, filters, sorts and pages them according to the query parameters (see search.go).
+// The page is sent as JSON, CSV or XML according to the Accept header (see formats.go).
+func getBooks(c *gin.Context) {
+	format := bookFormat(c)
+	if format == "" {
+		respondNotAcceptable(c)
+		return
+	}
+	query, err := parseBookQuery(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	books, err := store.List()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list books."})
+		return
+	}
+	respondBookPage(c, format, query.search(books))
+}
+
+// bookById functionHandles requests to '/books/id/ and retrieves a single book by its ID.
+// It calls the function to retrieve the book with the specified ID,
+// and returns the book in the format asked for by the Accept header, or an error message in JSON format.
+func bookById(c *gin.Context) {
+	format := bookFormat(c)
+	if format == "" {
+		respondNotAcceptable(c)
+		return
+	}
+	id := c.Param("id")
+	book, err := getBookById(id)
+	// If the book is not found, it returns a 404 Not Found status code.
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Book not found."})
+		return
+	}
+
+	// The ETag lets clients send If-Match on a later checkout or return to make sure the book has not changed in the meantime.
+	setBookETag(c, *book)
+	respondBookIn(c, format, *book)
+}
+
+// The checkoutBook function is a handler for the HTTP PATCH method on the "/checkout" endpoint.
+// It lends one copy of a book to a patron and records the loan with its due date.
+// The copy is picked by its "barcode" query parameter, or the first copy on the shelf of the book given by "id" is used.
+// The work is done by checkout, which the GraphQL checkout mutation shares (see graphql.go).
+func checkoutBook(c *gin.Context) {
+	// Extract the "id", "barcode", "patron" and "branch" query parameters from the HTTP request.
+	// Every loan belongs to a patron. Patrons borrow for themselves, so "patron" defaults to the caller's own patron ID.
+	req := checkoutRequest{
+		BookID:   c.Query("id"),
+		Barcode:  c.Query("barcode"),
+		PatronID: c.Query("patron"),
+		BranchID: c.Query("branch"),
+		IfMatch:  c.GetHeader("If-Match"),
+	}
+	if req.PatronID == "" {
+		req.PatronID = caller(c).PatronID
+	}
+
+	book, it, newLoan, err := checkout(caller(c), req)
+	if err != nil {
+		respondCirculationError(c, err, req.PatronID)
+		return
+	}
+
+	// Return a HTTP response with a 200 OK status code with the updated book, the copy and the new loan as a JSON response.
+	setBookETag(c, book)
+	c.IndentedJSON(http.StatusOK, gin.H{"book": book, "item": it, "loan": newLoan})
+}
+
+// A checkoutRequest names the copy to lend and the patron to lend it to. BookID, Barcode or both must be given.
+// BranchID, if set, is the branch lending the copy; without it a copy at any branch will do.
+// IfMatch is checked against the book's ETag as in updateBook.
+type checkoutRequest struct {
+	BookID   string
+	Barcode  string
+	PatronID string
+	BranchID string
+	IfMatch  string
+}
+
+// errMissingCopy and errMissingPatron are returned by checkout and returnCopy when the request does not say what or who it is for.
+var (
+	errMissingCopy   = errors.New("missing id or barcode")
+	errMissingPatron = errors.New("missing patron")
+)
+
+// errLoanClosed is returned by returnCopy when the loan has already been returned.
+var errLoanClosed = errors.New("loan already returned")
+
+// checkout lends a copy to a patron on behalf of the caller p and returns the updated book, the copy and the new loan.
+func checkout(p principal, req checkoutRequest) (book, item, loan, error) {
+	// If neither a book ID nor a barcode is given there is nothing to lend. The same goes for a missing patron.
+	if req.BookID == "" && req.Barcode == "" {
+		return book{}, item{}, loan{}, errMissingCopy
+	}
+	if req.PatronID == "" {
+		return book{}, item{}, loan{}, errMissingPatron
+	}
+
+	// Patrons may only borrow for themselves.
+	if !mayActFor(p, req.PatronID) {
+		return book{}, item{}, loan{}, errNotYourPatron
+	}
+
+	// The branch, if any, must exist.
+	if req.BranchID != "" {
+		if _, err := branches.Get(req.BranchID); err != nil {
+			return book{}, item{}, loan{}, err
+		}
+	}
+
+	// Hold circulationMu until the loan is recorded, so the copy cannot be lent twice and the book cannot be deleted in between.
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	// Nothing is lent once the event log has failed, as the loan could not be logged.
+	if err := eventLogWritable(); err != nil {
+		return book{}, item{}, loan{}, err
+	}
+
+	// Patrons who owe too much in fines, or who already have as many books as the borrowing policy allows, may not borrow.
+	if err := canBorrow(req.PatronID); err != nil {
+		return book{}, item{}, loan{}, err
+	}
+
+	// Find the copy being lent. A copy asked for by barcode must be on the shelf, at the requested branch
+	// and belong to the requested book, if any.
+	var it item
+	var err error
+	if req.Barcode != "" {
+		it, err = items.Get(req.Barcode)
+		if err == nil && req.BookID != "" && it.BookID != req.BookID {
+			err = errItemNotFound
+		}
+		if err == nil && req.BranchID != "" && it.BranchID != req.BranchID {
+			err = errWrongBranch
+		}
+		if err == nil && it.Status != itemAvailable {
+			err = errBookUnavailable
+		}
+	} else {
+		if _, err = store.Get(req.BookID); err == nil {
+			it, err = availableItem(req.BookID, req.BranchID)
+		}
+	}
+	if err != nil {
+		return book{}, item{}, loan{}, err
+	}
+
+	// The book, the copy and the loan are saved one after another. If a later write fails the earlier ones are undone.
+	var undo undoLog
+
+	// Decrement the quantity of the book by one and save it. updateBook retries if another request changed the book at the same time,
+	// and returns errPreconditionFailed if the book no longer matches If-Match.
+	b, err := updateBook(it.BookID, req.IfMatch, func(b *book) error {
+		if b.Quantity <= 0 {
+			return errBookUnavailable
+		}
+		b.Quantity -= 1
+		return nil
+	})
+	if err != nil {
+		return book{}, item{}, loan{}, err
+	}
+	undo.add(undoBookUpdate(b.ID, -1))
+	before := it
+	it.Status = itemOnLoan
+	if err := items.Update(it); err != nil {
+		undo.rollback()
+		return book{}, item{}, loan{}, err
+	}
+	undo.add(undoItemUpdate(before))
+
+	// Record who has the copy and when it is due back. The loan period depends on the patron's type.
+	now := time.Now().UTC()
+	newLoan := loan{
+		ID:           newID(),
+		BookID:       b.ID,
+		ItemBarcode:  it.Barcode,
+		BranchID:     it.BranchID,
+		PatronID:     req.PatronID,
+		CheckedOutAt: now,
+		DueAt:        now.Add(patronLoanPeriod(req.PatronID)),
+	}
+	if err := loans.Create(newLoan); err != nil {
+		undo.rollback()
+		return book{}, item{}, loan{}, err
+	}
+	undo.add(func() error { return loans.Delete(newLoan.ID) })
+
+	// A checkout that cannot be logged is undone, so the stores still match the log.
+	checkedOut, err := appendEvent(p.Name, event{Type: eventCheckedOut, Book: &b, Item: &it, Loan: &newLoan})
+	if err != nil {
+		undo.rollback()
+		return book{}, item{}, loan{}, err
+	}
+	notifyWebhooks(checkedOut)
+	return b, it, newLoan, nil
+}
+
+// The returnBook function handles requests to the /return endpoint and allows a patron to return a borrowed book to the library.
+// returnBook function is used to handle the PATCH request to return a book. It takes a gin.Context object as its only parameter
+// The work is done by returnCopy, which the GraphQL returnBook mutation shares (see graphql.go).
+func returnBook(c *gin.Context) {
+
+	// check if the loan or barcode query parameter is present in the request URL by calling the Query method of the gin.Context object.
+	// Either one identifies exactly which copy is coming back. An optional "condition" parameter records the state the copy came back in,
+	// and an optional "branch" parameter the branch it was handed in at, which then holds it.
+	req := returnRequest{
+		LoanID:    c.Query("loan"),
+		Barcode:   c.Query("barcode"),
+		Condition: c.Query("condition"),
+		BranchID:  c.Query("branch"),
+		IfMatch:   c.GetHeader("If-Match"),
+	}
+
+	book, l, reserved, fine, err := returnCopy(caller(c), req)
+	if err != nil {
+		respondCirculationError(c, err, "")
+		return
+	}
+
+	// and returns a 200 OK status code with the updated book, the closed loan, the hold the copy was reserved for and the fine (if any) in the response body as a JSON object.
+	setBookETag(c, book)
+	c.IndentedJSON(http.StatusOK, gin.H{"book": book, "loan": l, "hold": reserved, "fine": fine})
+}
+
+// A returnRequest names the loan being closed, directly or through the barcode of the copy coming back.
+// Condition and BranchID are optional: the state the copy came back in, and the branch it was handed in at, which then holds it.
+type returnRequest struct {
+	LoanID    string
+	Barcode   string
+	Condition string
+	BranchID  string
+	IfMatch   string
+}
+
+// returnCopy closes a loan on behalf of the caller p and puts the copy back into circulation.
+// It returns the updated book, the closed loan, the hold the copy was reserved for and the fine charged, if any.
+func returnCopy(p principal, req returnRequest) (book, loan, *hold, *ledgerEntry, error) {
+	// If neither a loan nor a barcode is given there is nothing to return.
+	if req.LoanID == "" && req.Barcode == "" {
+		return book{}, loan{}, nil, nil, errMissingCopy
+	}
+	if req.Condition != "" && !validCondition(req.Condition) {
+		return book{}, loan{}, nil, nil, validationError{"condition": "must be one of " + strings.Join(itemConditions, ", ")}
+	}
+	if req.BranchID != "" {
+		if _, err := branches.Get(req.BranchID); err != nil {
+			return book{}, loan{}, nil, nil, err
+		}
+	}
+
+	// Hold circulationMu while the loan is checked and closed, so two concurrent returns of the same loan cannot both succeed.
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	// Look up the loan, directly or through the open loan of the copy.
+	l, err := findReturnLoan(req.LoanID, req.Barcode)
+	if err != nil {
+		return book{}, loan{}, nil, nil, errLoanNotFound
+	}
+
+	// Patrons may only return their own loans.
+	if !mayActFor(p, l.PatronID) {
+		return book{}, loan{}, nil, nil, errNotYourPatron
+	}
+
+	// A loan can only be closed once.
+	if !l.open() {
+		return book{}, loan{}, nil, nil, errLoanClosed
+	}
+
+	// Nothing is returned once the event log has failed, as the return could not be logged.
+	if err := eventLogWritable(); err != nil {
+		return book{}, loan{}, nil, nil, err
+	}
+
+	// The copy, the book or hold, the loan and the ledger are saved one after another. If a later write fails the earlier ones are undone.
+	var undo undoLog
+	openLoan := l
+
+	// Find the copy. Loans made before copies were tracked have no barcode, so the returned copy is registered as a new one.
+	var it item
+	if l.ItemBarcode == "" {
+		it = item{Barcode: newBarcode(), BookID: l.BookID, BranchID: defaultBranchID, Condition: "good", Status: itemOnLoan, AddedAt: time.Now().UTC()}
+		if err := items.Create(it); err != nil {
+			return book{}, loan{}, nil, nil, err
+		}
+		barcode := it.Barcode
+		undo.add(func() error { return items.Delete(barcode) })
+		l.ItemBarcode = it.Barcode
+	} else if it, err = items.Get(l.ItemBarcode); err != nil {
+		return book{}, loan{}, nil, nil, err
+	}
+	onLoan := it
+	if req.Condition != "" {
+		it.Condition = req.Condition
+	}
+	if req.BranchID != "" {
+		it.BranchID = req.BranchID
+	}
+
+	// Put the copy back: it is set aside for the first patron waiting for the book if there is one,
+	// otherwise it goes back on the shelf and the Quantity field of the book is incremented by 1 and saved.
+	b, it, reserved, err := releaseCopy(onLoan, it, req.IfMatch, &undo)
+	if err != nil {
+		undo.rollback()
+		return book{}, loan{}, nil, nil, err
+	}
+
+	// Close the loan.
+	returnedAt := time.Now().UTC()
+	l.ReturnedAt = &returnedAt
+	if err := loans.Update(l); err != nil {
+		undo.rollback()
+		return book{}, loan{}, nil, nil, err
+	}
+	undo.add(func() error { return loans.Update(openLoan) })
+
+	// Charge the patron if the book came back late.
+	fine, err := chargeLateReturn(l)
+	if err != nil {
+		undo.rollback()
+		return book{}, loan{}, nil, nil, err
+	}
+	if fine != nil {
+		undo.add(func() error { return ledger.Delete(fine.ID) })
+	}
+
+	// A return that cannot be logged is undone, so the stores still match the log.
+	returned, err := appendEvent(p.Name, event{Type: eventReturned, Book: &b, Item: &it, Loan: &l, Hold: reserved, Entry: fine})
+	if err != nil {
+		undo.rollback()
+		return book{}, loan{}, nil, nil, err
+	}
+	notifyWebhooks(returned)
+	notifyIfBackInStock(returned)
+	return b, l, reserved, fine, nil
+}
+
+// respondCirculationError writes the HTTP response for an error returned by checkout, returnCopy or addBook.
+// patron is the patron the request was for, used to report their fines or loan limit.
+func respondCirculationError(c *gin.Context, err error, patron string) {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		respondValidationErrors(c, invalid)
+	case errors.Is(err, errMissingCopy):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing " + missingCopyParams(c) + " query parameter."})
+	case errors.Is(err, errMissingPatron):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Missing patron query parameter."})
+	case errors.Is(err, errNotYourPatron):
+		respondNotYourPatron(c)
+	case errors.Is(err, errFinesOutstanding):
+		respondFinesOutstanding(c, patron)
+	case errors.Is(err, errLoanLimit):
+		respondLoanLimit(c, patron)
+	case errors.Is(err, errLoanNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Loan not found."})
+	case errors.Is(err, errLoanClosed):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Loan already returned."})
+	case errors.Is(err, errDuplicateISBN):
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "A book with this ISBN already exists."})
+	case errors.Is(err, errBranchNotFound):
+		respondBranchError(c, err)
+	case errors.Is(err, errEventLogFailed):
+		respondEventLogError(c)
+	default:
+		respondItemError(c, err)
+	}
+}
+
+// missingCopyParams names the query parameters that identify a copy on the current route.
+func missingCopyParams(c *gin.Context) string {
+	if c.FullPath() == "/return" {
+		return "loan or barcode"
+	}
+	return "id or barcode"
+}
+
+// findReturnLoan returns the loan with the given ID, or if loanID is empty, the open loan of the copy with the given barcode.
+func findReturnLoan(loanID, barcode string) (loan, error) {
+	if loanID != "" {
+		return loans.Get(loanID)
+	}
+	open, err := filterLoans(func(l loan) bool {
+		return l.ItemBarcode == barcode && l.open()
+	})
+	if err != nil {
+		return loan{}, err
+	}
+	if len(open) == 0 {
+		return loan{}, errLoanNotFound
+	}
+	return open[0], nil
+}
+
+// getBookById is a helper function that takes an ID string and returns a pointer to a book struct and an error.
+// It looks the book up in the store and returns a pointer to a copy of it. Changes to the copy must be saved with store.Update.
+// If the book is not found, it returns a nil pointer and an error message.
+func getBookById(id string) (*book, error) {
+	b, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// The createBook function handles requests to the /books endpoint with a POST request method
+// and allows a user to create a new book by sending a JSON object in the request body. The function parses the
+// body, validates it and stores the book under a new ID chosen by the server. Any id in the body is ignored.
+// The quantity in the body is the number of new copies to put on the shelf, each with a generated barcode.
+// The work is done by addBook, which the GraphQL createBook mutation shares (see graphql.go).
+func createBook(c *gin.Context) {
+	var newBook book
+
+	// Bind the request body JSON data to the newBook variable
+	// If an error occurs while binding, return a 400 Bad Request status code
+	if err := c.ShouldBindJSON(&newBook); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON book."})
+		return
+	}
+
+	// Problems with the fields are reported all at once with a 422 Unprocessable Entity status code,
+	// and a second book with the same ISBN with a 409 Conflict status code.
+	created, err := addBook(caller(c), newBook)
+	if err != nil {
+		respondCirculationError(c, err, "")
+		return
+	}
+
+	// Respond with a JSON representation of the new book and a 201 Created status code
+	setBookETag(c, created)
+	c.IndentedJSON(http.StatusCreated, created)
+}
+
+// errDuplicateISBN is returned by addBook when another book already has the ISBN.
+var errDuplicateISBN = errors.New("a book with this ISBN already exists")
+
+// addBook validates a new book and adds it to the catalog on behalf of the caller p, along with its copies.
+func addBook(p principal, newBook book) (book, error) {
+	// Check every field and report all the problems at once.
+	if errs := newBook.validate(); errs != nil {
+		return book{}, validationError(errs)
+	}
+
+	// Hold circulationMu so two books with the same ISBN cannot be created at once.
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	// Nothing is added once the event log has failed, as the book could not be logged.
+	if err := eventLogWritable(); err != nil {
+		return book{}, err
+	}
+
+	// Each ISBN identifies one title, so a second book with the same ISBN is rejected.
+	if taken, err := isbnTaken(newBook.ISBN, ""); err != nil {
+		return book{}, err
+	} else if taken {
+		return book{}, errDuplicateISBN
+	}
+
+	// Add the new book to the store under a server-generated ID, along with its copies. They are logged once all are saved;
+	// if a write fails, the book and the copies already created are removed again.
+	var undo undoLog
+	newBook.ID = newID()
+	created, err := store.Create(newBook)
+	if err != nil {
+		return book{}, err
+	}
+	undo.add(func() error { return store.Delete(created.ID, created.Version) })
+	added, err := addCopies(created.ID, defaultBranchID, created.Quantity, "new")
+	for _, it := range added {
+		barcode := it.Barcode
+		undo.add(func() error { return items.Delete(barcode) })
+	}
+	if err != nil {
+		undo.rollback()
+		return book{}, err
+	}
+	logged, err := appendEvent(p.Name, event{Type: eventBookCreated, Book: &created})
+	if err != nil {
+		undo.rollback()
+		return book{}, err
+	}
+	for i := range added {
+		if _, err := appendEvent(p.Name, event{Type: eventItemAdded, Item: &added[i]}); err != nil {
+			undo.rollback()
+			return book{}, err
+		}
+	}
+	notifyWebhooks(logged)
+	return created, nil
+}
+
+// The router object sets up the routing for the API by defining the endpoints for each of the above functions and starting the server on port 8080.
+
+// A PATCH request is an HTTP method that is used to partially update a resource on the server.
+// It is similar to the HTTP PUT method, which is used to completely replace a resource on the server.
+// However, the PATCH method allows for more fine-grained updates of a resource by specifying only the fields that need to be updated,
+// instead of sending the entire resource with all its fields.
+// The PATCH request can be used in situations where updating a whole resource is unnecessary or undesirable.
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run sets the server up from the command line and serves until shutdown. Every failure is returned rather than
+// ending the process on the spot, so that the deferred closes of the event log and the bolt database still run.
+func run() error {
+	// The -store flag picks the catalog backend: "memory" (lost on restart) or "bolt" (kept in the file given by -db).
+	storeKind := flag.String("store", "memory", "catalog storage backend: memory or bolt")
+	dbPath := flag.String("db", "library.db", "path of the bolt database file when -store=bolt")
+	loanDays := flag.Int("loan-days", 14, "number of days a patron may keep a book")
+	flag.DurationVar(&pickupWindow, "pickup-window", pickupWindow, "how long a returned copy stays reserved for the first patron with a hold")
+	finesPath := flag.String("fines-policy", "", "path of a JSON fines policy file; the built-in policy is used if empty")
+	borrowingPath := flag.String("borrowing-policy", "", "path of a JSON borrowing policy file with loan limits, periods and renewals; the built-in policy is used if empty")
+	keysPath := flag.String("api-keys", "", "path of the JSON file listing API keys and their roles")
+	noAuth := flag.Bool("no-auth", false, "turn authentication off and treat every caller as a librarian (development only)")
+	eventLogPath := flag.String("event-log", "", "path of the JSON Lines circulation event log; events are kept in memory only if empty")
+	replay := flag.Bool("replay", false, "rebuild the memory store from -event-log instead of starting from the seed catalog; implied with -store memory when the log is not empty")
+	flag.StringVar(&defaultBranchID, "default-branch", defaultBranchID, "ID of the branch that new copies go to unless another is given")
+
+	// How the server listens. Each of these can also be set with the LIBRARY_* environment variable named in its help;
+	// a flag on the command line wins over the environment (see server.go).
+	var server serverConfig
+	flag.StringVar(&server.Addr, "addr", envString("LIBRARY_ADDR", "localhost:8080"), "host:port to listen on (LIBRARY_ADDR)")
+	flag.StringVar(&server.TLSCert, "tls-cert", envString("LIBRARY_TLS_CERT", ""), "path of the TLS certificate; HTTPS is served if set (LIBRARY_TLS_CERT)")
+	flag.StringVar(&server.TLSKey, "tls-key", envString("LIBRARY_TLS_KEY", ""), "path of the TLS private key (LIBRARY_TLS_KEY)")
+	flag.DurationVar(&server.ReadHeaderTimeout, "read-header-timeout", envDuration("LIBRARY_READ_HEADER_TIMEOUT", 5*time.Second), "how long a client may take to send request headers (LIBRARY_READ_HEADER_TIMEOUT)")
+	flag.DurationVar(&server.ReadTimeout, "read-timeout", envDuration("LIBRARY_READ_TIMEOUT", 30*time.Second), "how long a client may take to send a whole request (LIBRARY_READ_TIMEOUT)")
+	flag.DurationVar(&server.WriteTimeout, "write-timeout", envDuration("LIBRARY_WRITE_TIMEOUT", 30*time.Second), "how long a response may take to write (LIBRARY_WRITE_TIMEOUT)")
+	flag.DurationVar(&server.IdleTimeout, "idle-timeout", envDuration("LIBRARY_IDLE_TIMEOUT", 2*time.Minute), "how long an idle keep-alive connection stays open (LIBRARY_IDLE_TIMEOUT)")
+	flag.DurationVar(&server.ShutdownTimeout, "shutdown-timeout", envDuration("LIBRARY_SHUTDOWN_TIMEOUT", 20*time.Second), "how long to wait for in-flight requests on SIGTERM (LIBRARY_SHUTDOWN_TIMEOUT)")
+	flag.Parse()
+
+	if (server.TLSCert == "") != (server.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	switch {
+	case *keysPath != "":
+		keys, err := loadAPIKeys(*keysPath)
+		if err != nil {
+			return fmt.Errorf("failed to load API keys: %w", err)
+		}
+		apiKeys = keys
+	case *noAuth:
+		log.Println("Authentication is turned off, every caller is a librarian")
+	default:
+		return errors.New("no API keys given: use -api-keys, or -no-auth for development")
+	}
+
+	if *finesPath != "" {
+		p, err := loadFinePolicy(*finesPath)
+		if err != nil {
+			return fmt.Errorf("failed to load fines policy: %w", err)
+		}
+		fines = p
+	}
+
+	if *borrowingPath != "" {
+		p, err := loadBorrowingPolicy(*borrowingPath)
+		if err != nil {
+			return fmt.Errorf("failed to load borrowing policy: %w", err)
+		}
+		borrowing = p
+	}
+
+	loanPeriod = time.Duration(*loanDays) * 24 * time.Hour
+
+	// Every change is written to the event log. With -replay the log is the source of truth for the memory store.
+	if *replay && (*storeKind != "memory" || *eventLogPath == "") {
+		return errors.New("-replay needs -store memory and an -event-log file")
+	}
+	if *eventLogPath != "" {
+		l, err := openFileEventLog(*eventLogPath)
+		if err != nil {
+			return fmt.Errorf("failed to open event log: %w", err)
+		}
+		defer l.Close()
+		events = l
+	} else {
+		events = newMemoryEventLog()
+	}
+	logEmpty, err := eventLogEmpty()
+	if err != nil {
+		return fmt.Errorf("failed to read event log: %w", err)
+	}
+	// A memory store starts from the seed catalog, which is not what a log that is already in use describes.
+	// Starting from it would serve, and go on logging, a state the log cannot be replayed to, so the log is replayed instead.
+	if *storeKind == "memory" && !logEmpty && !*replay {
+		log.Println("The event log is not empty, so the memory store is rebuilt from it as with -replay")
+		*replay = true
+	}
+
+	var seeded []book
+	switch *storeKind {
+	case "memory":
+		store = newMemoryBookStore(seedBooks)
+		loans = newMemoryLoanStore()
+		holds = newMemoryHoldStore()
+		items = newMemoryItemStore()
+		ledger = newMemoryLedgerStore()
+		webhooks = newMemoryWebhookStore()
+		deliveries = newMemoryDeliveryStore()
+		branches = newMemoryBranchStore()
+		transfers = newMemoryTransferStore()
+	case "bolt":
+		db, err := openBoltDB(*dbPath)
+		if err != nil {
+			return fmt.Errorf("failed to open bolt database: %w", err)
+		}
+		defer db.Close()
+		store, seeded, err = newBoltBookStore(db, seedBooks)
+		if err != nil {
+			return fmt.Errorf("failed to prepare bolt store: %w", err)
+		}
+		loans = newBoltLoanStore(db)
+		holds = newBoltHoldStore(db)
+		items = newBoltItemStore(db)
+		ledger = newBoltLedgerStore(db)
+		webhooks = newBoltWebhookStore(db)
+		deliveries = newBoltDeliveryStore(db)
+		branches = newBoltBranchStore(db)
+		transfers = newBoltTransferStore(db)
+	default:
+		return fmt.Errorf("unknown store %q, expected memory or bolt", *storeKind)
+	}
+
+	if *replay {
+		if err := replayEvents(); err != nil {
+			return fmt.Errorf("failed to replay event log: %w", err)
+		}
+	} else {
+		// A new log starts with a snapshot of the state it was opened on, so that it can be replayed on its own.
+		if err := snapshotState(); err != nil {
+			return fmt.Errorf("failed to write event log snapshot: %w", err)
+		}
+		// A bolt catalog that was only now seeded, next to a log already in use, is logged as new books.
+		if !logEmpty {
+			for i := range seeded {
+				if _, err := appendEvent("", event{Type: eventBookCreated, Book: &seeded[i]}); err != nil {
+					return fmt.Errorf("failed to log seeded books: %w", err)
+				}
+			}
+		}
+		// Books from a catalog saved before copies were tracked get a copy for each unit of Quantity.
+		if err := backfillItems(); err != nil {
+			return fmt.Errorf("failed to create copies for existing books: %w", err)
+		}
+	}
+
+	// Copies from before there were branches are held at the default branch, which is created if needed.
+	if err := backfillBranches(); err != nil {
+		return fmt.Errorf("failed to set up the default branch: %w", err)
+	}
+
+	// Background workers run until serve cancels workerCtx on shutdown, and are waited for before the stores are closed.
+	workerCtx, stopWorkerCtx := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	workers.Add(2)
+
+	// Reserved copies whose pickup window has run out are passed on in the background.
+	go func() {
+		defer workers.Done()
+		expireHoldsEvery(workerCtx, time.Minute)
+	}()
+
+	// Webhook deliveries are sent, and failed ones retried, in the background.
+	go func() {
+		defer workers.Done()
+		deliverWebhooks(workerCtx, time.Second)
+	}()
+
+	// Every route needs an API key (see auth.go). Routes marked librarian are closed to patrons,
+	// and routes marked self only let patrons see their own records.
+	librarian := requireLibrarian()
+	self := requireSelf()
+	// Routes in openapi.json are checked against it after the caller's role, so a patron who may not make a request
+	// is told so rather than what is wrong with its body (see openapi.go).
+	validate := validateRequests()
+
+	router := gin.Default()
+	// Health checks and the OpenAPI document are registered before authenticate so that load balancers,
+	// orchestrators and client generators need no API key.
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", readyz)
+	router.GET("/openapi.json", openAPISpecHandler)
+	// Once the event log cannot be written, requests that would change something are refused (see events.go).
+	router.Use(authenticate(), refuseWritesAfterLogFailure())
+	router.GET("/books", validate, getBooks)
+	router.GET("/books/:id", validate, bookById)
+	router.POST("/books", librarian, validate, createBook)
+	router.POST("/books/import", librarian, importBooks)
+	router.PUT("/books/:id", librarian, validate, putBook)
+	router.PATCH("/books/:id", librarian, validate, patchBook)
+	router.DELETE("/books/:id", librarian, validate, deleteBook)
+	router.GET("/books/:id/items", bookItems)
+	router.GET("/books/:id/stock", bookStock)
+	router.POST("/books/:id/items", librarian, addItem)
+	router.GET("/items/:barcode", getItem)
+	router.PATCH("/items/:barcode", librarian, updateItem)
+	router.DELETE("/items/:barcode", librarian, withdrawItem)
+	router.GET("/fines/policy", getFinePolicy)
+	router.GET("/patrons/:id/account", self, getAccount)
+	router.POST("/patrons/:id/payments", librarian, recordPayment)
+	router.POST("/patrons/:id/waivers", librarian, recordWaiver)
+	router.PATCH("/checkout", validate, checkoutBook)
+	router.PATCH("/return", validate, returnBook)
+	router.GET("/loans", librarian, openLoans)
+	router.GET("/loans/overdue", librarian, overdueLoans)
+	router.PATCH("/loans/:id/renew", renewLoan)
+	router.GET("/borrowing/policy", getBorrowingPolicy)
+	router.GET("/patrons/:id/loans", self, patronLoans)
+	router.GET("/books/:id/holds", librarian, bookHolds)
+	router.POST("/books/:id/holds", placeHold)
+	router.GET("/patrons/:id/holds", self, patronHolds)
+	router.DELETE("/holds/:id", cancelHold)
+	router.PATCH("/holds/:id/fulfil", fulfilHold)
+	router.GET("/events", librarian, listEvents)
+	router.GET("/branches", listBranches)
+	router.GET("/branches/:id", getBranch)
+	router.POST("/branches", librarian, createBranch)
+	router.PUT("/branches/:id", librarian, updateBranch)
+	router.GET("/branches/:id/stock", branchStock)
+	router.GET("/transfers", librarian, listTransfers)
+	router.POST("/transfers", librarian, requestTransfer)
+	router.GET("/transfers/:id", librarian, getTransfer)
+	router.PATCH("/transfers/:id/dispatch", librarian, dispatchTransfer)
+	router.PATCH("/transfers/:id/receive", librarian, receiveTransfer)
+	router.DELETE("/transfers/:id", librarian, cancelTransfer)
+	router.GET("/webhooks", librarian, listWebhooks)
+	router.POST("/webhooks", librarian, createWebhook)
+	router.GET("/webhooks/:id", librarian, getWebhook)
+	router.DELETE("/webhooks/:id", librarian, deleteWebhook)
+	router.GET("/webhooks/:id/deliveries", librarian, listDeliveries)
+	router.GET("/deliveries/dead", librarian, deadLetters)
+	router.POST("/deliveries/:id/redeliver", librarian, redeliver)
+	router.GET("/reports/popular", librarian, popularReport)
+	router.GET("/reports/utilisation", librarian, utilisationReport)
+	router.GET("/reports/loan-length", librarian, loanLengthReport)
+	router.GET("/reports/daily-checkouts", librarian, dailyCheckoutsReport)
+	router.GET("/graphql", serveGraphQL)
+	router.POST("/graphql", serveGraphQL)
+
+	// Serve until SIGINT or SIGTERM, then let in-flight requests finish before the stores are closed by the deferred calls above.
+	stopWorkers := func() {
+		stopWorkerCtx()
+		workers.Wait()
+	}
+	if err := serve(router, server, stopWorkers); err != nil {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPIDocument is the OpenAPI 3 description of the catalog and circulation routes, served at /openapi.json
+// and used by validateRequests.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// An openAPISpec holds the parts of the OpenAPI document that requests are checked against.
+// Operations are keyed by method and then by path in Gin's form, e.g. "PATCH" and "/books/:id".
+type openAPISpec struct {
+	operations map[string]map[string]openAPIOperation
+	components openAPIComponents
+}
+
+type openAPIComponents struct {
+	Schemas    map[string]*jsonSchema       `json:"schemas"`
+	Parameters map[string]*openAPIParameter `json:"parameters"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *jsonSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref      string      `json:"$ref"`
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Required bool        `json:"required"`
+	Schema   *jsonSchema `json:"schema"`
+}
+
+// A jsonSchema is the subset of OpenAPI schema objects that the validator understands. Other keywords are ignored.
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       string                 `json:"type"`
+	Nullable   bool                   `json:"nullable"`
+	Enum       []interface{}          `json:"enum"`
+	Minimum    *float64               `json:"minimum"`
+	Maximum    *float64               `json:"maximum"`
+	MinLength  *int                   `json:"minLength"`
+	MaxLength  *int                   `json:"maxLength"`
+	Pattern    string                 `json:"pattern"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Required   []string               `json:"required"`
+	Items      *jsonSchema            `json:"items"`
+	pattern    *regexp.Regexp         // Pattern, compiled by mustParseOpenAPI
+}
+
+// A contractViolation is one way a request does not match the OpenAPI document.
+type contractViolation struct {
+	In      string `json:"in"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// pathParam matches an OpenAPI path parameter such as {id}, to turn it into Gin's :id.
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// libraryAPI is the parsed openAPIDocument.
+var libraryAPI = mustParseOpenAPI(openAPIDocument)
+
+// mustParseOpenAPI parses an OpenAPI document, panicking if it is malformed since it is built into the binary.
+func mustParseOpenAPI(data []byte) *openAPISpec {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components openAPIComponents                     `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		panic("openapi.json: " + err.Error())
+	}
+	spec := &openAPISpec{operations: map[string]map[string]openAPIOperation{}, components: doc.Components}
+	for path, item := range doc.Paths {
+		ginPath := pathParam.ReplaceAllString(path, ":$1")
+		for method, raw := range item {
+			switch method {
+			case "get", "put", "post", "patch", "delete":
+			default:
+				continue
+			}
+			var op openAPIOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				panic("openapi.json: " + method + " " + path + ": " + err.Error())
+			}
+			for i, p := range op.Parameters {
+				op.Parameters[i] = spec.parameter(p)
+				compilePatterns(op.Parameters[i].Schema)
+			}
+			if op.RequestBody != nil {
+				for _, content := range op.RequestBody.Content {
+					compilePatterns(content.Schema)
+				}
+			}
+			m := strings.ToUpper(method)
+			if spec.operations[m] == nil {
+				spec.operations[m] = map[string]openAPIOperation{}
+			}
+			spec.operations[m][ginPath] = op
+		}
+	}
+	for _, s := range spec.components.Schemas {
+		compilePatterns(s)
+	}
+	return spec
+}
+
+// compilePatterns compiles the pattern of a schema and of the schemas inside it, so requests can be checked concurrently.
+func compilePatterns(s *jsonSchema) {
+	if s == nil {
+		return
+	}
+	if s.Pattern != "" && s.pattern == nil {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	for _, prop := range s.Properties {
+		compilePatterns(prop)
+	}
+	compilePatterns(s.Items)
+}
+
+// parameter follows a parameter's $ref, if it has one.
+func (spec *openAPISpec) parameter(p *openAPIParameter) *openAPIParameter {
+	if p.Ref == "" {
+		return p
+	}
+	ref, ok := spec.components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	if !ok {
+		panic("openapi.json: unknown parameter " + p.Ref)
+	}
+	return ref
+}
+
+// schema follows a schema's $ref, if it has one.
+func (spec *openAPISpec) schema(s *jsonSchema) *jsonSchema {
+	for s != nil && s.Ref != "" {
+		ref, ok := spec.components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+		if !ok {
+			panic("openapi.json: unknown schema " + s.Ref)
+		}
+		s = ref
+	}
+	return s
+}
+
+// check appends to violations every way value, decoded from JSON, does not match the schema.
+func (spec *openAPISpec) check(s *jsonSchema, value interface{}, in, name string, violations []contractViolation) []contractViolation {
+	s = spec.schema(s)
+	if s == nil {
+		return violations
+	}
+	fail := func(message string) []contractViolation {
+		return append(violations, contractViolation{In: in, Name: name, Message: message})
+	}
+	if value == nil {
+		if s.Nullable {
+			return violations
+		}
+		return fail("must not be null")
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				return fail("must not be empty")
+			}
+			return fail("must be at least " + strconv.Itoa(*s.MinLength) + " characters")
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most " + strconv.Itoa(*s.MaxLength) + " characters")
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fail("must match " + s.Pattern)
+		}
+	case "integer", "number":
+		f, ok := value.(float64)
+		if !ok || (s.Type == "integer" && f != math.Trunc(f)) {
+			return fail("must be " + map[string]string{"integer": "an integer", "number": "a number"}[s.Type])
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("must be at most " + strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("must be true or false")
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fail("must be an array")
+		}
+		for i, v := range list {
+			violations = spec.check(s.Items, v, in, name+"["+strconv.Itoa(i)+"]", violations)
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			if name == "" {
+				return fail("must be a JSON object")
+			}
+			return fail("must be an object")
+		}
+		prefix := ""
+		if name != "" {
+			prefix = name + "."
+		}
+		for _, field := range s.Required {
+			if _, ok := obj[field]; !ok {
+				violations = append(violations, contractViolation{In: in, Name: prefix + field, Message: "is required"})
+			}
+		}
+		fields := make([]string, 0, len(obj))
+		for field := range obj {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if prop, ok := s.Properties[field]; ok {
+				violations = spec.check(prop, obj[field], in, prefix+field, violations)
+			}
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		options := make([]string, len(s.Enum))
+		for i, option := range s.Enum {
+			if option == value {
+				return violations
+			}
+			options[i], _ = option.(string)
+		}
+		return fail("must be one of " + strings.Join(options, ", "))
+	}
+	return violations
+}
+
+// parseParameter converts a query or path parameter to the JSON type its schema expects, so it can be checked like a body field.
+// Values that do not convert are passed through as strings, for check to reject.
+func (spec *openAPISpec) parseParameter(p *openAPIParameter, raw string) interface{} {
+	s := spec.schema(p.Schema)
+	if s == nil {
+		return raw
+	}
+	switch s.Type {
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+// validateRequest returns every way the request does not match its operation in the document.
+// Requests to routes the document does not describe are not checked.
+func (spec *openAPISpec) validateRequest(c *gin.Context) ([]contractViolation, error) {
+	op, ok := spec.operations[c.Request.Method][c.FullPath()]
+	if !ok {
+		return nil, nil
+	}
+	violations := []contractViolation{}
+	for _, p := range op.Parameters {
+		var raw string
+		var present bool
+		switch p.In {
+		case "query":
+			raw, present = c.GetQuery(p.Name)
+		case "path":
+			raw = c.Param(p.Name)
+			present = true
+		default:
+			continue
+		}
+		if !present {
+			if p.Required {
+				violations = append(violations, contractViolation{In: p.In, Name: p.Name, Message: "is required"})
+			}
+			continue
+		}
+		violations = spec.check(p.Schema, spec.parseParameter(p, raw), p.In, p.Name, violations)
+	}
+
+	if op.RequestBody != nil {
+		// The body is read here and put back for the handler. Its media type is not enforced,
+		// since the handlers have always accepted JSON whatever the Content-Type.
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		var schema *jsonSchema
+		for _, content := range op.RequestBody.Content {
+			schema = content.Schema
+			break
+		}
+		switch {
+		case len(bytes.TrimSpace(body)) == 0:
+			if op.RequestBody.Required {
+				violations = append(violations, contractViolation{In: "body", Name: "", Message: "is required"})
+			}
+		default:
+			var value interface{}
+			if err := json.Unmarshal(body, &value); err != nil {
+				violations = append(violations, contractViolation{In: "body", Name: "", Message: "must be valid JSON"})
+			} else {
+				violations = spec.check(schema, value, "body", "", violations)
+			}
+		}
+	}
+	return violations, nil
+}
+
+// validateRequests is Gin middleware that checks requests against the OpenAPI document before they reach the handlers,
+// answering 400 Bad Request with every violation found. It is added to each route in the document after authentication
+// and role checks, so callers who may not use a route get 401 or 403 whatever they send. Value rules the document cannot express, such as ISBN check digits,
+// are still left to the handlers, which answer 422 Unprocessable Entity.
+func validateRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		violations, err := libraryAPI.validateRequest(c)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Could not read request body."})
+			c.Abort()
+			return
+		}
+		if len(violations) > 0 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request does not match the API specification.", "errors": violations})
+			c.Abort()
+		}
+	}
+}
+
+// openAPISpecHandler handles GET /openapi.json and serves the OpenAPI document.
+func openAPISpecHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIDocument)
+}
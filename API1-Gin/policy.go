@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errLoanLimit is returned when a patron already has as many loans open as the policy allows.
+var errLoanLimit = errors.New("patron has reached the loan limit")
+
+// defaultPatronType is the patron type used for patrons whose API key does not give one.
+const defaultPatronType = "adult"
+
+// A borrowingPolicy sets how much a patron may borrow, for how long, and how often a loan may be renewed.
+// Types overrides these for patrons of a given type (see principal.PatronType); fields left out fall back to the defaults.
+// A MaxLoans of 0 means no limit. LoanDays of 0 means the -loan-days flag.
+type borrowingPolicy struct {
+	MaxLoans    int                   `json:"max_loans"`
+	LoanDays    int                   `json:"loan_days"`
+	MaxRenewals int                   `json:"max_renewals"`
+	Types       map[string]patronRule `json:"types,omitempty"`
+}
+
+// A patronRule overrides parts of the borrowing policy for one patron type.
+type patronRule struct {
+	MaxLoans    *int `json:"max_loans,omitempty"`
+	LoanDays    *int `json:"loan_days,omitempty"`
+	MaxRenewals *int `json:"max_renewals,omitempty"`
+}
+
+// defaultBorrowingPolicy is the policy used when no -borrowing-policy file is given, and the base a policy file is read on top of.
+var defaultBorrowingPolicy = borrowingPolicy{
+	MaxLoans:    10,
+	MaxRenewals: 2,
+}
+
+// borrowing is the policy in force. It can be replaced at startup with the -borrowing-policy flag.
+var borrowing = defaultBorrowingPolicy
+
+// loadBorrowingPolicy reads a borrowingPolicy from a JSON file. Keys left out of the file keep their default values,
+// so a file that only sets the loan period does not also lift the loan limit or forbid renewals.
+func loadBorrowingPolicy(path string) (borrowingPolicy, error) {
+	p := defaultBorrowingPolicy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	return p, p.validate()
+}
+
+// validate rejects values that cannot be meant. No value may be negative, and a patron type that overrides
+// max_loans or loan_days must give at least 1: unlike at the top level, 0 there would silently mean "no limit" or "-loan-days".
+func (p borrowingPolicy) validate() error {
+	if p.MaxLoans < 0 || p.LoanDays < 0 || p.MaxRenewals < 0 {
+		return errors.New("max_loans, loan_days and max_renewals must not be negative")
+	}
+	for name, o := range p.Types {
+		if o.MaxLoans != nil && *o.MaxLoans < 1 {
+			return errors.New("types." + name + ".max_loans must be at least 1")
+		}
+		if o.LoanDays != nil && *o.LoanDays < 1 {
+			return errors.New("types." + name + ".loan_days must be at least 1")
+		}
+		if o.MaxRenewals != nil && *o.MaxRenewals < 0 {
+			return errors.New("types." + name + ".max_renewals must not be negative")
+		}
+	}
+	return nil
+}
+
+// rulesFor returns the loan limit, loan period and renewal limit for a patron type.
+func (p borrowingPolicy) rulesFor(patronType string) (maxLoans int, period time.Duration, maxRenewals int) {
+	maxLoans, days, maxRenewals := p.MaxLoans, p.LoanDays, p.MaxRenewals
+	if o, ok := p.Types[patronType]; ok {
+		if o.MaxLoans != nil {
+			maxLoans = *o.MaxLoans
+		}
+		if o.LoanDays != nil {
+			days = *o.LoanDays
+		}
+		if o.MaxRenewals != nil {
+			maxRenewals = *o.MaxRenewals
+		}
+	}
+	period = loanPeriod
+	if days > 0 {
+		period = time.Duration(days) * 24 * time.Hour
+	}
+	return maxLoans, period, maxRenewals
+}
+
+// patronType returns the type of a patron, taken from the first API key that belongs to them.
+func patronType(patron string) string {
+	for _, p := range apiKeys {
+		if p.PatronID == patron && p.PatronType != "" {
+			return p.PatronType
+		}
+	}
+	return defaultPatronType
+}
+
+// patronLoanPeriod returns how long the patron may keep a book.
+func patronLoanPeriod(patron string) time.Duration {
+	_, period, _ := borrowing.rulesFor(patronType(patron))
+	return period
+}
+
+// checkLoanLimit returns errLoanLimit if the patron may not open another loan.
+func checkLoanLimit(patron string) error {
+	maxLoans, _, _ := borrowing.rulesFor(patronType(patron))
+	if maxLoans <= 0 {
+		return nil
+	}
+	open, err := filterLoans(func(l loan) bool {
+		return l.PatronID == patron && l.open()
+	})
+	if err != nil {
+		return err
+	}
+	if len(open) >= maxLoans {
+		return errLoanLimit
+	}
+	return nil
+}
+
+// respondLoanLimit writes a 403 Forbidden response telling the patron how many loans they may have.
+func respondLoanLimit(c *gin.Context, patron string) {
+	maxLoans, _, _ := borrowing.rulesFor(patronType(patron))
+	c.IndentedJSON(http.StatusForbidden, gin.H{
+		"message":   "Patron already has as many books as they may borrow.",
+		"max_loans": maxLoans,
+	})
+}
+
+// canBorrow runs the checks every new loan must pass, fines first. It returns errFinesOutstanding or errLoanLimit
+// if the patron may not borrow.
+func canBorrow(patron string) error {
+	if err := checkFines(patron); err != nil {
+		return err
+	}
+	return checkLoanLimit(patron)
+}
+
+// checkBorrowing runs canBorrow and writes the 403 response if a check fails. It reports whether the patron may borrow.
+func checkBorrowing(c *gin.Context, patron string) bool {
+	err := canBorrow(patron)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errFinesOutstanding):
+		respondFinesOutstanding(c, patron)
+	case errors.Is(err, errLoanLimit):
+		respondLoanLimit(c, patron)
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load account."})
+	}
+	return false
+}
+
+// getBorrowingPolicy handles GET /borrowing/policy.
+func getBorrowingPolicy(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"policy":              borrowing,
+		"default_loan_days":   int(loanPeriod / (24 * time.Hour)),
+		"default_patron_type": defaultPatronType,
+	})
+}
+
+// renewLoan handles PATCH /loans/:id/renew and gives the patron another loan period, counted from now.
+// A loan cannot be renewed once it is overdue, more often than the policy allows, or while another patron is waiting for the book.
+func renewLoan(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	l, err := loans.Get(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Loan not found."})
+		return
+	}
+	if !allowedPatron(c, l.PatronID) {
+		return
+	}
+	if !l.open() {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Loan already returned."})
+		return
+	}
+	now := time.Now().UTC()
+	if l.overdue(now) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Overdue loans cannot be renewed, the book must be returned."})
+		return
+	}
+	_, period, maxRenewals := borrowing.rulesFor(patronType(l.PatronID))
+	if l.Renewals >= maxRenewals {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"message": "Loan has been renewed as often as the policy allows.", "renewals": l.Renewals, "max_renewals": maxRenewals})
+		return
+	}
+	if err := checkFines(l.PatronID); errors.Is(err, errFinesOutstanding) {
+		respondFinesOutstanding(c, l.PatronID)
+		return
+	} else if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load account."})
+		return
+	}
+	waiting, err := filterHolds(func(h hold) bool {
+		return h.BookID == l.BookID && h.Status == holdWaiting && h.PatronID != l.PatronID
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list holds."})
+		return
+	}
+	if len(waiting) > 0 {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Another patron is waiting for this book, so the loan cannot be renewed."})
+		return
+	}
+
+	if due := now.Add(period); due.After(l.DueAt) {
+		l.DueAt = due
+	}
+	l.Renewals++
+	if err := loans.Update(l); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not renew loan."})
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventRenewed, Loan: &l}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, l)
+}
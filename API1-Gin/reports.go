@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportDate is the layout of the from and to query parameters and of dates in reports.
+const reportDate = "2006-01-02"
+
+// defaultReportDays is how far back a report goes when no from date is given, and maxReportDays how far it can go at most.
+const (
+	defaultReportDays = 30
+	maxReportDays     = 3660
+)
+
+// A reportRange is the span of days a report covers, in UTC. To is the start of the day after the last one.
+type reportRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseReportRange reads the from and to query parameters, both inclusive dates like 2024-01-31.
+// Without them a report covers the last 30 days up to and including today.
+func parseReportRange(c *gin.Context) (reportRange, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	last := today
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(reportDate, v)
+		if err != nil {
+			return reportRange{}, errors.New("to must be a date like 2024-01-31")
+		}
+		last = t
+	}
+	first := last.AddDate(0, 0, 1-defaultReportDays)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(reportDate, v)
+		if err != nil {
+			return reportRange{}, errors.New("from must be a date like 2024-01-01")
+		}
+		first = t
+	}
+	if first.After(last) {
+		return reportRange{}, errors.New("from must not be after to")
+	}
+	if last.Sub(first) >= maxReportDays*24*time.Hour {
+		return reportRange{}, errors.New("reports cannot cover more than " + strconv.Itoa(maxReportDays) + " days")
+	}
+	return reportRange{From: first, To: last.AddDate(0, 0, 1)}, nil
+}
+
+// contains reports whether t falls on one of the days of the range.
+func (r reportRange) contains(t time.Time) bool {
+	return !t.Before(r.From) && t.Before(r.To)
+}
+
+// String returns the range as it is written in CSV file names, e.g. 2024-01-01_2024-01-31.
+func (r reportRange) String() string {
+	return r.From.Format(reportDate) + "_" + r.To.AddDate(0, 0, -1).Format(reportDate)
+}
+
+// fields returns the first and last day of the range, to start a report's JSON body with.
+func (r reportRange) fields() gin.H {
+	return gin.H{"from": r.From.Format(reportDate), "to": r.To.AddDate(0, 0, -1).Format(reportDate)}
+}
+
+// wantsCSV reports whether the client asked for CSV, with format=csv or an Accept header naming text/csv.
+func wantsCSV(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(c.GetHeader("Accept"), "text/csv")
+}
+
+// respondReport writes a report either as JSON (body) or, if the client asked for it, as a CSV download
+// with the given file name, header row and rows.
+func respondReport(c *gin.Context, name string, body gin.H, header []string, rows [][]string) {
+	if !wantsCSV(c) {
+		c.IndentedJSON(http.StatusOK, body)
+		return
+	}
+	writeCSV(c, name, header, rows)
+}
+
+// loadReportData returns every loan and every book, indexed by ID, for the report handlers.
+func loadReportData(c *gin.Context) ([]loan, map[string]book, bool) {
+	all, err := loans.List()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load loans."})
+		return nil, nil, false
+	}
+	list, err := store.List()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load books."})
+		return nil, nil, false
+	}
+	books := map[string]book{}
+	for _, b := range list {
+		books[b.ID] = b
+	}
+	return all, books, true
+}
+
+// A titleCount is one row of the most borrowed titles report. Title and author are empty for books that have since been deleted.
+type titleCount struct {
+	BookID    string `json:"book_id"`
+	ISBN      string `json:"isbn"`
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	Checkouts int    `json:"checkouts"`
+}
+
+// An authorCount is one row of the most borrowed authors report.
+type authorCount struct {
+	Author    string `json:"author"`
+	Titles    int    `json:"titles"`
+	Checkouts int    `json:"checkouts"`
+}
+
+// popularReport handles GET /reports/popular?by=title|author&from=&to=&limit=
+// and ranks titles or authors by the number of checkouts made in the date range.
+func popularReport(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	by := c.DefaultQuery("by", "title")
+	if by != "title" && by != "author" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "by must be title or author"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+		return
+	}
+	all, books, ok := loadReportData(c)
+	if !ok {
+		return
+	}
+
+	perBook := map[string]int{}
+	for _, l := range all {
+		if r.contains(l.CheckedOutAt) {
+			perBook[l.BookID]++
+		}
+	}
+	titles := []titleCount{}
+	for id, n := range perBook {
+		b := books[id]
+		titles = append(titles, titleCount{BookID: id, ISBN: b.ISBN, Title: b.Title, Author: b.Author, Checkouts: n})
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		if titles[i].Checkouts != titles[j].Checkouts {
+			return titles[i].Checkouts > titles[j].Checkouts
+		}
+		return titles[i].BookID < titles[j].BookID
+	})
+
+	body := r.fields()
+	body["by"] = by
+	if by == "title" {
+		if len(titles) > limit {
+			titles = titles[:limit]
+		}
+		rows := [][]string{}
+		for _, t := range titles {
+			rows = append(rows, []string{t.BookID, t.ISBN, t.Title, t.Author, strconv.Itoa(t.Checkouts)})
+		}
+		body["titles"] = titles
+		respondReport(c, "popular-titles_"+r.String(), body, []string{"book_id", "isbn", "title", "author", "checkouts"}, rows)
+		return
+	}
+
+	perAuthor := map[string]*authorCount{}
+	authors := []*authorCount{}
+	for _, t := range titles {
+		if t.Author == "" {
+			continue
+		}
+		a, ok := perAuthor[t.Author]
+		if !ok {
+			a = &authorCount{Author: t.Author}
+			perAuthor[t.Author] = a
+			authors = append(authors, a)
+		}
+		a.Titles++
+		a.Checkouts += t.Checkouts
+	}
+	sort.SliceStable(authors, func(i, j int) bool {
+		if authors[i].Checkouts != authors[j].Checkouts {
+			return authors[i].Checkouts > authors[j].Checkouts
+		}
+		return authors[i].Author < authors[j].Author
+	})
+	if len(authors) > limit {
+		authors = authors[:limit]
+	}
+	rows := [][]string{}
+	for _, a := range authors {
+		rows = append(rows, []string{a.Author, strconv.Itoa(a.Titles), strconv.Itoa(a.Checkouts)})
+	}
+	body["authors"] = authors
+	respondReport(c, "popular-authors_"+r.String(), body, []string{"author", "titles", "checkouts"}, rows)
+}
+
+// A titleUtilisation compares the copies of a book that are out on loan with those still on the shelf.
+type titleUtilisation struct {
+	BookID      string  `json:"book_id"`
+	ISBN        string  `json:"isbn"`
+	Title       string  `json:"title"`
+	CopiesOut   int     `json:"copies_out"`
+	Quantity    int     `json:"quantity"`
+	Utilisation float64 `json:"utilisation"`
+}
+
+// utilisationReport handles GET /reports/utilisation and shows, for every title, how many copies are out
+// against its Quantity on the shelf. Utilisation is the share of circulating copies that are out, from 0 to 1.
+func utilisationReport(c *gin.Context) {
+	all, books, ok := loadReportData(c)
+	if !ok {
+		return
+	}
+	out := map[string]int{}
+	for _, l := range all {
+		if l.open() {
+			out[l.BookID]++
+		}
+	}
+	list := []titleUtilisation{}
+	for _, b := range books {
+		u := titleUtilisation{BookID: b.ID, ISBN: b.ISBN, Title: b.Title, CopiesOut: out[b.ID], Quantity: b.Quantity}
+		if total := u.CopiesOut + u.Quantity; total > 0 {
+			u.Utilisation = math.Round(float64(u.CopiesOut)/float64(total)*1000) / 1000
+		}
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Utilisation != list[j].Utilisation {
+			return list[i].Utilisation > list[j].Utilisation
+		}
+		return list[i].BookID < list[j].BookID
+	})
+
+	rows := [][]string{}
+	for _, u := range list {
+		rows = append(rows, []string{u.BookID, u.ISBN, u.Title, strconv.Itoa(u.CopiesOut), strconv.Itoa(u.Quantity), strconv.FormatFloat(u.Utilisation, 'f', 3, 64)})
+	}
+	body := gin.H{"as_of": time.Now().UTC(), "titles": list}
+	respondReport(c, "utilisation_"+time.Now().UTC().Format(reportDate), body, []string{"book_id", "isbn", "title", "copies_out", "quantity", "utilisation"}, rows)
+}
+
+// loanLengthReport handles GET /reports/loan-length?from=&to= and averages how long loans returned in the date range were kept.
+func loanLengthReport(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	all, _, ok := loadReportData(c)
+	if !ok {
+		return
+	}
+	var returned int
+	var total time.Duration
+	for _, l := range all {
+		if !l.open() && r.contains(*l.ReturnedAt) {
+			returned++
+			total += l.ReturnedAt.Sub(l.CheckedOutAt)
+		}
+	}
+	var average float64
+	if returned > 0 {
+		average = math.Round(total.Hours()/24/float64(returned)*100) / 100
+	}
+
+	body := r.fields()
+	body["returned_loans"] = returned
+	body["average_days"] = average
+	rows := [][]string{{body["from"].(string), body["to"].(string), strconv.Itoa(returned), strconv.FormatFloat(average, 'f', 2, 64)}}
+	respondReport(c, "loan-length_"+r.String(), body, []string{"from", "to", "returned_loans", "average_days"}, rows)
+}
+
+// A dayCount is the number of checkouts made on one day.
+type dayCount struct {
+	Date      string `json:"date"`
+	Checkouts int    `json:"checkouts"`
+}
+
+// dailyCheckoutsReport handles GET /reports/daily-checkouts?from=&to= and counts checkouts per day, including days with none.
+func dailyCheckoutsReport(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	all, _, ok := loadReportData(c)
+	if !ok {
+		return
+	}
+	perDay := map[string]int{}
+	for _, l := range all {
+		if r.contains(l.CheckedOutAt) {
+			perDay[l.CheckedOutAt.UTC().Format(reportDate)]++
+		}
+	}
+	days := []dayCount{}
+	rows := [][]string{}
+	for d := r.From; d.Before(r.To); d = d.AddDate(0, 0, 1) {
+		date := d.Format(reportDate)
+		days = append(days, dayCount{Date: date, Checkouts: perDay[date]})
+		rows = append(rows, []string{date, strconv.Itoa(perDay[date])})
+	}
+
+	body := r.fields()
+	body["days"] = days
+	respondReport(c, "daily-checkouts_"+r.String(), body, []string{"date", "checkouts"}, rows)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPageSize and maxPageSize bound the limit query parameter of GET /books.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// The ways a search term can be matched against a title or author, chosen with the match query parameter.
+const (
+	matchContains = "contains"
+	matchPrefix   = "prefix"
+	matchFuzzy    = "fuzzy"
+)
+
+// A bookQuery is the parsed set of search, filter, sort and paging parameters for GET /books.
+type bookQuery struct {
+	Q         string // matched against title or author
+	ISBN      string
+	Title     string
+	Author    string
+	Match     string
+	Available *bool
+	SortField string
+	Desc      bool
+	Limit     int
+	Offset    int
+	After     *bookCursor
+}
+
+// A bookPage is one page of GET /books results. Total counts every book that matched, not just this page.
+type bookPage struct {
+	Books      []book `json:"books"`
+	Total      int    `json:"total"`
+	Offset     int    `json:"offset"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// A bookCursor marks the last book of a page. The next page starts at the first book that sorts after it.
+// It is sent to clients as base64-encoded JSON, and only applies to the sort order it was created with.
+type bookCursor struct {
+	Sort     string `json:"s"`
+	ID       string `json:"id"`
+	Title    string `json:"t"`
+	Author   string `json:"a"`
+	Quantity int    `json:"q"`
+}
+
+// parseBookQuery reads the GET /books query parameters:
+//
+//	q, title, author   case-insensitive search terms
+//	isbn               exact ISBN-10 or ISBN-13, with or without hyphens
+//	match              contains (default), prefix or fuzzy
+//	available          true for books with copies on the shelf, false for books without
+//	sort               title, author or quantity, prefixed with - for descending order
+//	limit, offset      page size and position
+//	cursor             next_cursor from a previous page, used instead of offset
+func parseBookQuery(c *gin.Context) (bookQuery, error) {
+	return readBookQuery(c.GetQuery)
+}
+
+// readBookQuery builds a bookQuery from the parameters described at parseBookQuery, looked up with get.
+// The GraphQL books query passes its arguments through here too (see graphql.go).
+func readBookQuery(get func(key string) (string, bool)) (bookQuery, error) {
+	value := func(key, fallback string) string {
+		if v, ok := get(key); ok && v != "" {
+			return v
+		}
+		return fallback
+	}
+	q := bookQuery{
+		Q:      strings.TrimSpace(value("q", "")),
+		Title:  strings.TrimSpace(value("title", "")),
+		Author: strings.TrimSpace(value("author", "")),
+		Match:  value("match", matchContains),
+		Limit:  defaultPageSize,
+	}
+
+	switch q.Match {
+	case matchContains, matchPrefix, matchFuzzy:
+	default:
+		return q, errors.New("match must be contains, prefix or fuzzy")
+	}
+
+	if v := value("isbn", ""); v != "" {
+		isbn, err := normalizeISBN(v)
+		if err != nil {
+			return q, errors.New("isbn " + err.Error())
+		}
+		q.ISBN = isbn
+	}
+
+	if v, ok := get("available"); ok {
+		available, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, errors.New("available must be true or false")
+		}
+		q.Available = &available
+	}
+
+	sortParam := value("sort", "id")
+	q.Desc = strings.HasPrefix(sortParam, "-")
+	q.SortField = strings.TrimPrefix(sortParam, "-")
+	switch q.SortField {
+	case "id", "title", "author", "quantity":
+	default:
+		return q, errors.New("sort must be id, title, author or quantity")
+	}
+
+	if v, ok := get("limit"); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		q.Limit = limit
+	}
+	if v, ok := get("offset"); ok {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return q, errors.New("offset must be a non-negative integer")
+		}
+		q.Offset = offset
+	}
+	if v, ok := get("cursor"); ok {
+		if _, hasOffset := get("offset"); hasOffset {
+			return q, errors.New("use either cursor or offset, not both")
+		}
+		cur, err := decodeBookCursor(v)
+		if err != nil || cur.Sort != sortParam {
+			return q, errors.New("cursor is invalid or was made for a different sort")
+		}
+		q.After = &cur
+	}
+	return q, nil
+}
+
+// matches reports whether a book passes the query's search terms and filters.
+func (q bookQuery) matches(b book) bool {
+	if q.Available != nil && (b.Quantity > 0) != *q.Available {
+		return false
+	}
+	if q.ISBN != "" && b.ISBN != q.ISBN {
+		return false
+	}
+	if q.Title != "" && !matchText(q.Match, q.Title, b.Title) {
+		return false
+	}
+	if q.Author != "" && !matchText(q.Match, q.Author, b.Author) {
+		return false
+	}
+	if q.Q != "" && !matchText(q.Match, q.Q, b.Title) && !matchText(q.Match, q.Q, b.Author) {
+		return false
+	}
+	return true
+}
+
+// less orders books by the query's sort field, falling back to the ID so the order is stable across pages.
+func (q bookQuery) less(a, b book) bool {
+	var cmp int
+	switch q.SortField {
+	case "title":
+		cmp = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+	case "author":
+		cmp = strings.Compare(strings.ToLower(a.Author), strings.ToLower(b.Author))
+	case "quantity":
+		cmp = a.Quantity - b.Quantity
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID, b.ID)
+	}
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// search filters, sorts and pages books according to the query.
+//
+// GET /books and the GraphQL books query pass it the whole catalog from store.List, as neither backend can filter
+// or sort, so every page costs time and memory in proportion to the catalog rather than to the page.
+// That is a known limit. It keeps the cost down where it can: with a cursor, books at or before it are
+// only counted and never sorted.
+func (q bookQuery) search(books []book) bookPage {
+	var last book
+	if q.After != nil {
+		last = q.After.book()
+	}
+	matched := []book{}
+	total, skipped := 0, 0
+	for _, b := range books {
+		if !q.matches(b) {
+			continue
+		}
+		total++
+		if q.After != nil && !q.less(last, b) {
+			skipped++
+			continue
+		}
+		matched = append(matched, b)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(matched[i], matched[j])
+	})
+
+	start := 0
+	if q.After == nil {
+		start = q.Offset
+	}
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + q.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := bookPage{
+		Books:  matched[start:end],
+		Total:  total,
+		Offset: skipped + start,
+		Limit:  q.Limit,
+	}
+	if end < len(matched) {
+		page.NextCursor = encodeBookCursor(q, matched[end-1])
+	}
+	return page
+}
+
+// book returns the sort keys held in the cursor as a book, so it can be compared with bookQuery.less.
+func (cur bookCursor) book() book {
+	return book{ID: cur.ID, Title: cur.Title, Author: cur.Author, Quantity: cur.Quantity}
+}
+
+// encodeBookCursor returns the cursor for the page that starts after b.
+func encodeBookCursor(q bookQuery, b book) string {
+	sortParam := q.SortField
+	if q.Desc {
+		sortParam = "-" + sortParam
+	}
+	data, _ := json.Marshal(bookCursor{Sort: sortParam, ID: b.ID, Title: b.Title, Author: b.Author, Quantity: b.Quantity})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeBookCursor parses a cursor made by encodeBookCursor.
+func decodeBookCursor(s string) (bookCursor, error) {
+	var cur bookCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(data, &cur)
+	return cur, err
+}
+
+// matchText reports whether the search term matches the text, ignoring case.
+//
+//	contains  the term appears anywhere in the text
+//	prefix    some word of the text starts with the term
+//	fuzzy     every word of the term is within a small edit distance of, or a prefix of, some word of the text
+func matchText(mode, term, text string) bool {
+	term = strings.ToLower(term)
+	text = strings.ToLower(text)
+	switch mode {
+	case matchPrefix:
+		if strings.HasPrefix(text, term) {
+			return true
+		}
+		for _, word := range strings.Fields(text) {
+			if strings.HasPrefix(word, term) {
+				return true
+			}
+		}
+		return false
+	case matchFuzzy:
+		if strings.Contains(text, term) {
+			return true
+		}
+		words := strings.Fields(text)
+		for _, t := range strings.Fields(term) {
+			if !fuzzyWordMatch(t, words) {
+				return false
+			}
+		}
+		return true
+	default:
+		return strings.Contains(text, term)
+	}
+}
+
+// fuzzyWordMatch reports whether term is a prefix of one of the words, or close to it by edit distance.
+// Longer terms tolerate more typos: one per four letters, at least one.
+func fuzzyWordMatch(term string, words []string) bool {
+	allowed := len([]rune(term)) / 4
+	if allowed < 1 {
+		allowed = 1
+	}
+	for _, w := range words {
+		if strings.HasPrefix(w, term) || levenshtein(term, w) <= allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// levenshtein returns the number of single-rune insertions, deletions and substitutions needed to turn a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
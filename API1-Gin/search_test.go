@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSearchCursorPagesMatchOffsetPages(t *testing.T) {
+	var books []book
+	for i := 0; i < 25; i++ {
+		books = append(books, book{ID: strconv.Itoa(i), Title: "Title " + strconv.Itoa(i%7), Author: "Author", Quantity: i % 3})
+	}
+	get := func(params map[string]string) bookQuery {
+		q, err := readBookQuery(func(key string) (string, bool) {
+			v, ok := params[key]
+			return v, ok
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	cursor := ""
+	for offset := 0; offset < 25; offset += 4 {
+		byOffset := get(map[string]string{"sort": "-title", "limit": "4", "offset": strconv.Itoa(offset)}).search(books)
+		params := map[string]string{"sort": "-title", "limit": "4"}
+		if offset > 0 {
+			params["cursor"] = cursor
+		}
+		byCursor := get(params).search(books)
+		if byCursor.Total != 25 || byCursor.Offset != offset || len(byCursor.Books) != len(byOffset.Books) {
+			t.Fatalf("offset %d: got total %d, offset %d and %d books by cursor, want 25, %d and %d",
+				offset, byCursor.Total, byCursor.Offset, len(byCursor.Books), offset, len(byOffset.Books))
+		}
+		for i := range byOffset.Books {
+			if byCursor.Books[i].ID != byOffset.Books[i].ID {
+				t.Errorf("offset %d, book %d: got %s by cursor, want %s", offset, i, byCursor.Books[i].ID, byOffset.Books[i].ID)
+			}
+		}
+		if (byCursor.NextCursor == "") != (offset+4 >= 25) {
+			t.Errorf("offset %d: got next cursor %q", offset, byCursor.NextCursor)
+		}
+		cursor = byCursor.NextCursor
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serverConfig is how the HTTP server listens and how long it waits. It is filled in main from flags,
+// whose defaults come from the LIBRARY_* environment variables.
+type serverConfig struct {
+	Addr              string
+	TLSCert           string
+	TLSKey            string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+}
+
+// envString returns the environment variable name, or fallback if it is not set.
+func envString(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// envDuration returns the environment variable name parsed as a duration such as "30s", or fallback if it is not set.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s must be a duration such as 30s: %v", name, err)
+	}
+	return d
+}
+
+// ready is 1 once the stores are open and the server is listening, and goes back to 0 when shutdown starts,
+// so that load balancers stop sending requests while the in-flight ones finish.
+var ready int32
+
+// healthz handles GET /healthz. It answers as long as the process is running.
+func healthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz handles GET /readyz. It answers 200 OK only while the server is accepting work and the stores can be read.
+func readyz(c *gin.Context) {
+	if atomic.LoadInt32(&ready) == 0 {
+		c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "message": "Server is starting or shutting down."})
+		return
+	}
+	if _, err := branches.Get(defaultBranchID); err != nil {
+		c.IndentedJSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "message": "Could not read the store."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// serve runs the HTTP server, over TLS if a certificate and key are configured, until SIGINT or SIGTERM.
+// It reports ready only once the address is bound and the certificate loaded.
+// On a signal it stops accepting connections and waits up to ShutdownTimeout for in-flight requests to finish, closing
+// whatever connections are left after that. It then calls stopWorkers, which must return once the background workers
+// have stopped, and finally takes circulationMu, so no checkout, return or hold expiry is left half done when main
+// returns and closes the stores. It returns an error only if the server could not listen.
+func serve(handler http.Handler, config serverConfig, stopWorkers func()) error {
+	if config.TLSCert != "" {
+		// ServeTLS loads the pair again; loading it here first fails before the server is reported ready.
+		if _, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		var err error
+		if config.TLSCert != "" {
+			log.Printf("Listening on https://%s", ln.Addr())
+			err = srv.ServeTLS(ln, config.TLSCert, config.TLSKey)
+		} else {
+			log.Printf("Listening on http://%s", ln.Addr())
+			err = srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+	atomic.StoreInt32(&ready, 1)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	select {
+	case err := <-failed:
+		atomic.StoreInt32(&ready, 0)
+		stopWorkers()
+		return err
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	atomic.StoreInt32(&ready, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %v, closing their connections: %v", config.ShutdownTimeout, err)
+		srv.Close()
+	} else {
+		log.Println("All requests finished")
+	}
+	stopWorkers()
+	circulationMu.Lock()
+	return nil
+}
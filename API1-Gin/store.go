@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// errBookNotFound is returned by a BookStore when no book has the requested ID.
+var errBookNotFound = errors.New("book not found")
+
+// errBookExists is returned by a BookStore when a book is created with an ID that is already taken.
+var errBookExists = errors.New("book already exists")
+
+// errVersionConflict is returned by BookStore.Update when the stored book has a different version from the one being saved,
+// meaning someone else saved the book after it was read.
+var errVersionConflict = errors.New("book was modified concurrently")
+
+// BookStore is the persistence layer for the catalog.
+// The handlers only talk to the catalog through this interface, so the backing storage can be chosen at startup.
+//
+// Every book carries a Version. Create stores version 1 and each successful Update bumps it by one,
+// so a read-modify-write that raced with another writer is caught instead of silently overwriting it.
+type BookStore interface {
+	// List returns every book in the catalog.
+	List() ([]book, error)
+	// Get returns the book with the given ID, or errBookNotFound.
+	Get(id string) (book, error)
+	// Create adds a new book at version 1 and returns it, or returns errBookExists if the ID is already taken.
+	Create(b book) (book, error)
+	// Update saves b if the stored book still has b.Version and returns it with the new version.
+	// It returns errBookNotFound or errVersionConflict otherwise.
+	Update(b book) (book, error)
+	// Delete removes the book if the stored book still has the given version.
+	// It returns errBookNotFound or errVersionConflict otherwise.
+	Delete(id string, version int) error
+}
+
+// seedBooks is the starting catalog used by a fresh store.
+var seedBooks = []book{
+	{ID: "1", ISBN: "9780142437964", Title: "In Search of Lost Time", Author: "Marcel Proust", Type: "general", Quantity: 2, Version: 1},
+	{ID: "2", ISBN: "9780743273565", Title: "The Great Gatsby", Author: "F. Scott Fitzgerald", Type: "general", Quantity: 5, Version: 1},
+	{ID: "3", ISBN: "9781400079988", Title: "War and Peace", Author: "Leo Tolstoy", Type: "general", Quantity: 6, Version: 1},
+}
+
+// memoryBookStore keeps the catalog in a slice, so everything is lost when the process exits.
+type memoryBookStore struct {
+	mu    sync.RWMutex
+	books []book
+}
+
+// newMemoryBookStore returns a memoryBookStore holding a copy of the given books.
+func newMemoryBookStore(initial []book) *memoryBookStore {
+	return &memoryBookStore{books: append([]book(nil), initial...)}
+}
+
+func (s *memoryBookStore) List() ([]book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]book(nil), s.books...), nil
+}
+
+func (s *memoryBookStore) Get(id string) (book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if i := s.indexOf(id); i >= 0 {
+		return s.books[i], nil
+	}
+	return book{}, errBookNotFound
+}
+
+func (s *memoryBookStore) Create(b book) (book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexOf(b.ID) >= 0 {
+		return book{}, errBookExists
+	}
+	b.Version = 1
+	s.books = append(s.books, b)
+	return b, nil
+}
+
+func (s *memoryBookStore) Update(b book) (book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOf(b.ID)
+	if i < 0 {
+		return book{}, errBookNotFound
+	}
+	if s.books[i].Version != b.Version {
+		return book{}, errVersionConflict
+	}
+	b.Version++
+	s.books[i] = b
+	return b, nil
+}
+
+func (s *memoryBookStore) Delete(id string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOf(id)
+	if i < 0 {
+		return errBookNotFound
+	}
+	if s.books[i].Version != version {
+		return errVersionConflict
+	}
+	s.books = append(s.books[:i], s.books[i+1:]...)
+	return nil
+}
+
+// put stores b as it is, replacing any book with the same ID. It is used to replay the event log.
+func (s *memoryBookStore) put(b book) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.indexOf(b.ID); i >= 0 {
+		s.books[i] = b
+		return
+	}
+	s.books = append(s.books, b)
+}
+
+// remove deletes the book with the given ID, if there is one. It is used to replay the event log.
+func (s *memoryBookStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.indexOf(id); i >= 0 {
+		s.books = append(s.books[:i], s.books[i+1:]...)
+	}
+}
+
+// indexOf returns the position of the book with the given ID, or -1. The caller must hold the lock.
+func (s *memoryBookStore) indexOf(id string) int {
+	for i, b := range s.books {
+		if b.ID == id {
+			return i
+		}
+	}
+	return -1
+}
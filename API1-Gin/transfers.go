@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errTransferNotFound is returned by a TransferStore when no transfer has the requested ID.
+var errTransferNotFound = errors.New("transfer not found")
+
+// The states of a transfer, in the order they happen. A transfer can only be cancelled before it is dispatched.
+const (
+	transferRequested = "requested"
+	transferInTransit = "in_transit"
+	transferReceived  = "received"
+	transferCancelled = "cancelled"
+)
+
+// A transfer moves one copy of a book from one branch to another. The copy is picked when the transfer is dispatched,
+// unless the request named it by barcode.
+type transfer struct {
+	ID           string     `json:"id"`
+	BookID       string     `json:"book_id"`
+	ItemBarcode  string     `json:"item_barcode,omitempty"`
+	FromBranchID string     `json:"from_branch_id"`
+	ToBranchID   string     `json:"to_branch_id"`
+	Status       string     `json:"status"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	ReceivedAt   *time.Time `json:"received_at,omitempty"`
+}
+
+// TransferStore is the persistence layer for transfers, with the same memory and bolt backends as BookStore.
+type TransferStore interface {
+	// List returns every transfer, oldest first.
+	List() ([]transfer, error)
+	// Get returns the transfer with the given ID, or errTransferNotFound.
+	Get(id string) (transfer, error)
+	// Create adds a new transfer.
+	Create(t transfer) error
+	// Update overwrites an existing transfer, or returns errTransferNotFound.
+	Update(t transfer) error
+}
+
+// transfers holds every transfer between branches. It is chosen in main alongside store.
+var transfers TransferStore
+
+// memoryTransferStore keeps transfers in a map, so they are lost when the process exits.
+type memoryTransferStore struct {
+	mu        sync.RWMutex
+	transfers map[string]transfer
+}
+
+func newMemoryTransferStore() *memoryTransferStore {
+	return &memoryTransferStore{transfers: map[string]transfer{}}
+}
+
+func (s *memoryTransferStore) List() ([]transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]transfer, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		list = append(list, t)
+	}
+	sortTransfers(list)
+	return list, nil
+}
+
+func (s *memoryTransferStore) Get(id string) (transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.transfers[id]
+	if !ok {
+		return transfer{}, errTransferNotFound
+	}
+	return t, nil
+}
+
+func (s *memoryTransferStore) Create(t transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfers[t.ID] = t
+	return nil
+}
+
+func (s *memoryTransferStore) Update(t transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transfers[t.ID]; !ok {
+		return errTransferNotFound
+	}
+	s.transfers[t.ID] = t
+	return nil
+}
+
+// sortTransfers orders transfers by the time they were requested, then by ID.
+func sortTransfers(list []transfer) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].RequestedAt.Equal(list[j].RequestedAt) {
+			return list[i].RequestedAt.Before(list[j].RequestedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// filterTransfers returns the transfers for which keep returns true.
+func filterTransfers(keep func(transfer) bool) ([]transfer, error) {
+	all, err := transfers.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []transfer{}
+	for _, t := range all {
+		if keep(t) {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// respondTransferError writes the HTTP response for an error returned while working on a transfer.
+func respondTransferError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTransferNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Transfer not found."})
+	case errors.Is(err, errBranchNotFound), errors.Is(err, errBranchExists):
+		respondBranchError(c, err)
+	default:
+		respondItemError(c, err)
+	}
+}
+
+// transferInput is the body of a transfer request. Either book_id or barcode must be given;
+// from_branch_id defaults to the branch the copy is at when a barcode is given.
+type transferInput struct {
+	BookID       string `json:"book_id"`
+	Barcode      string `json:"barcode"`
+	FromBranchID string `json:"from_branch_id"`
+	ToBranchID   string `json:"to_branch_id"`
+}
+
+// listTransfers handles GET /transfers?status=&branch= and lists transfers, optionally only those
+// in one state or into or out of one branch.
+func listTransfers(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", transferRequested, transferInTransit, transferReceived, transferCancelled:
+	default:
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "status must be requested, in_transit, received or cancelled"})
+		return
+	}
+	branchID := c.Query("branch")
+	list, err := filterTransfers(func(t transfer) bool {
+		return (status == "" || t.Status == status) &&
+			(branchID == "" || t.FromBranchID == branchID || t.ToBranchID == branchID)
+	})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not list transfers."})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getTransfer handles GET /transfers/:id.
+func getTransfer(c *gin.Context) {
+	t, err := transfers.Get(c.Param("id"))
+	if err != nil {
+		respondTransferError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, t)
+}
+
+// requestTransfer handles POST /transfers and asks for a copy of a book, or a particular copy, to be sent to another branch.
+func requestTransfer(c *gin.Context) {
+	var input transferInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON transfer."})
+		return
+	}
+
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	problems := map[string]string{}
+	if input.Barcode != "" {
+		it, err := items.Get(input.Barcode)
+		switch {
+		case errors.Is(err, errItemNotFound):
+			problems["barcode"] = "must be an existing copy"
+		case err != nil:
+			respondItemError(c, err)
+			return
+		case input.BookID != "" && input.BookID != it.BookID:
+			problems["barcode"] = "must be a copy of book_id"
+		case input.FromBranchID != "" && input.FromBranchID != it.BranchID:
+			problems["barcode"] = "must be a copy held at from_branch_id"
+		default:
+			input.BookID = it.BookID
+			input.FromBranchID = it.BranchID
+		}
+	} else if input.BookID == "" {
+		problems["book_id"] = "is required unless a barcode is given"
+	} else if _, err := store.Get(input.BookID); errors.Is(err, errBookNotFound) {
+		problems["book_id"] = "must be an existing book"
+	} else if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	for field, id := range map[string]string{"from_branch_id": input.FromBranchID, "to_branch_id": input.ToBranchID} {
+		if _, ok := problems["barcode"]; ok && field == "from_branch_id" {
+			continue
+		}
+		if id == "" {
+			problems[field] = "is required"
+		} else if _, err := branches.Get(id); errors.Is(err, errBranchNotFound) {
+			problems[field] = "must be an existing branch"
+		} else if err != nil {
+			respondBranchError(c, err)
+			return
+		}
+	}
+	if input.FromBranchID != "" && input.FromBranchID == input.ToBranchID {
+		problems["to_branch_id"] = "must differ from from_branch_id"
+	}
+	if len(problems) > 0 {
+		respondValidationErrors(c, problems)
+		return
+	}
+
+	t := transfer{
+		ID:           newID(),
+		BookID:       input.BookID,
+		ItemBarcode:  input.Barcode,
+		FromBranchID: input.FromBranchID,
+		ToBranchID:   input.ToBranchID,
+		Status:       transferRequested,
+		RequestedAt:  time.Now().UTC(),
+	}
+	if err := transfers.Create(t); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not record transfer."})
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventTransferRequested, Transfer: &t}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, t)
+}
+
+// loadTransfer fetches the transfer named in the URL and checks it is in the wanted state,
+// writing a 404 or 409 response if not.
+func loadTransfer(c *gin.Context, status string) (transfer, bool) {
+	t, err := transfers.Get(c.Param("id"))
+	if err != nil {
+		respondTransferError(c, err)
+		return transfer{}, false
+	}
+	if t.Status != status {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Transfer is " + t.Status + ", not " + status + "."})
+		return transfer{}, false
+	}
+	return t, true
+}
+
+// dispatchTransfer handles PATCH /transfers/:id/dispatch. The copy leaves the shelf at the sending branch,
+// so its book's Quantity goes down by one until the copy is received.
+func dispatchTransfer(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	t, ok := loadTransfer(c, transferRequested)
+	if !ok {
+		return
+	}
+	var it item
+	var err error
+	if t.ItemBarcode != "" {
+		it, err = items.Get(t.ItemBarcode)
+		if err == nil && (it.Status != itemAvailable || it.BranchID != t.FromBranchID) {
+			err = errBookUnavailable
+		}
+	} else {
+		it, err = availableItem(t.BookID, t.FromBranchID)
+	}
+	if errors.Is(err, errBookUnavailable) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "No copy for this transfer is on the shelf at " + t.FromBranchID + "."})
+		return
+	} else if err != nil {
+		respondItemError(c, err)
+		return
+	}
+
+	var undo undoLog
+	b, err := updateBook(it.BookID, "", func(b *book) error {
+		b.Quantity -= 1
+		return nil
+	})
+	if err != nil {
+		respondBookError(c, err)
+		return
+	}
+	undo.add(undoBookUpdate(b.ID, -1))
+	before := it
+	it.Status = itemInTransit
+	if err := items.Update(it); err != nil {
+		undo.rollback()
+		respondItemError(c, err)
+		return
+	}
+	undo.add(undoItemUpdate(before))
+	requested := t
+	now := time.Now().UTC()
+	t.ItemBarcode = it.Barcode
+	t.Status = transferInTransit
+	t.DispatchedAt = &now
+	if err := transfers.Update(t); err != nil {
+		undo.rollback()
+		respondTransferError(c, err)
+		return
+	}
+	undo.add(func() error { return transfers.Update(requested) })
+	if _, err := recordEvent(c, event{Type: eventTransferDispatched, Transfer: &t, Book: &b, Item: &it}); err != nil {
+		undo.rollback()
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"transfer": t, "book": b, "item": it})
+}
+
+// receiveTransfer handles PATCH /transfers/:id/receive. The copy now belongs to the receiving branch and is put back
+// into circulation there: on the shelf, or set aside for the first patron waiting for the book.
+func receiveTransfer(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	t, ok := loadTransfer(c, transferInTransit)
+	if !ok {
+		return
+	}
+	it, err := items.Get(t.ItemBarcode)
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+	stored := it
+	it.BranchID = t.ToBranchID
+	var undo undoLog
+	b, it, reserved, err := releaseCopy(stored, it, "", &undo)
+	if err != nil {
+		undo.rollback()
+		respondItemError(c, err)
+		return
+	}
+	sent := t
+	now := time.Now().UTC()
+	t.Status = transferReceived
+	t.ReceivedAt = &now
+	if err := transfers.Update(t); err != nil {
+		undo.rollback()
+		respondTransferError(c, err)
+		return
+	}
+	undo.add(func() error { return transfers.Update(sent) })
+	received, err := recordEvent(c, event{Type: eventTransferReceived, Transfer: &t, Book: &b, Item: &it, Hold: reserved})
+	if err != nil {
+		undo.rollback()
+		respondEventLogError(c)
+		return
+	}
+	notifyIfBackInStock(received)
+	c.IndentedJSON(http.StatusOK, gin.H{"transfer": t, "book": b, "item": it, "hold": reserved})
+}
+
+// cancelTransfer handles DELETE /transfers/:id. Only transfers that have not been dispatched can be cancelled.
+func cancelTransfer(c *gin.Context) {
+	circulationMu.Lock()
+	defer circulationMu.Unlock()
+
+	t, ok := loadTransfer(c, transferRequested)
+	if !ok {
+		return
+	}
+	t.Status = transferCancelled
+	if err := transfers.Update(t); err != nil {
+		respondTransferError(c, err)
+		return
+	}
+	if _, err := recordEvent(c, event{Type: eventTransferCancelled, Transfer: &t}); err != nil {
+		respondEventLogError(c)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, t)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "log"
+
+// An undoLog collects, step by step, how to reverse the writes a circulation change has made so far.
+// Circulation changes touch several stores one after another; if a later write fails, rollback puts the earlier ones back,
+// so the stores never disagree, e.g. a book's Quantity lowered with no loan to show for it.
+type undoLog []func() error
+
+// add records how to reverse a write that has just succeeded.
+func (u *undoLog) add(step func() error) {
+	*u = append(*u, step)
+}
+
+// rollback reverses the recorded writes, newest first. A step that fails is logged and the others are still run,
+// since there is nothing further to fall back on.
+func (u *undoLog) rollback() {
+	for i := len(*u) - 1; i >= 0; i-- {
+		if err := (*u)[i](); err != nil {
+			log.Printf("Error rolling back a partial circulation change: %v", err)
+		}
+	}
+	*u = nil
+}
+
+// undoBookUpdate returns the step that reverses a change of delta to a book's Quantity.
+// It adjusts the current Quantity rather than restoring the old book, so a concurrent edit of the other fields is kept.
+func undoBookUpdate(id string, delta int) func() error {
+	return func() error {
+		_, err := updateBook(id, "", func(b *book) error {
+			b.Quantity -= delta
+			return nil
+		})
+		return err
+	}
+}
+
+// undoItemUpdate returns the step that puts a copy back as it was.
+func undoItemUpdate(before item) func() error {
+	return func() error {
+		return items.Update(before)
+	}
+}
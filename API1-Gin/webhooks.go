@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errWebhookNotFound is returned by a WebhookStore when no subscription has the requested ID.
+var errWebhookNotFound = errors.New("webhook not found")
+
+// errDeliveryNotFound is returned by a DeliveryStore when no delivery has the requested ID.
+var errDeliveryNotFound = errors.New("delivery not found")
+
+// eventBookAvailable is sent to webhooks when a copy goes on the shelf of a book that had none there: a return,
+// a reserved copy released after its hold expired or was cancelled, a transfer received or a new copy added.
+// It is not written to the event log, which has the event that put the copy on the shelf instead.
+const eventBookAvailable = "book.available"
+
+// webhookEvents lists the event types a webhook can subscribe to.
+var webhookEvents = []string{eventBookCreated, eventCheckedOut, eventReturned, eventBookAvailable}
+
+// The states of a delivery. Pending deliveries are retried until they succeed or run out of attempts and become dead letters.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// maxDeliveryAttempts is how many times a delivery is tried before it becomes a dead letter.
+// The wait before each retry doubles, starting at webhookRetryBase.
+const maxDeliveryAttempts = 8
+
+// webhookRetryBase is the wait before the first retry of a failed delivery.
+var webhookRetryBase = 10 * time.Second
+
+// webhookClient sends deliveries. Receivers that take longer than its timeout count as failed.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// A webhook is a subscription to some event types. Every matching event is POSTed as JSON to URL,
+// signed with Secret. The secret is only shown when the webhook is created.
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// withoutSecret returns the webhook as it is shown after creation.
+func (w webhook) withoutSecret() webhook {
+	w.Secret = ""
+	return w
+}
+
+// wants reports whether the webhook is subscribed to the event type.
+func (w webhook) wants(eventType string) bool {
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// A delivery is one event on its way to one webhook. Payload is the exact body sent, so redeliveries are identical.
+type delivery struct {
+	ID            string          `json:"id"`
+	WebhookID     string          `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastStatus    int             `json:"last_status,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// WebhookStore is the persistence layer for webhook subscriptions, with the same memory and bolt backends as BookStore.
+type WebhookStore interface {
+	// List returns every webhook, oldest first.
+	List() ([]webhook, error)
+	// Get returns the webhook with the given ID, or errWebhookNotFound.
+	Get(id string) (webhook, error)
+	// Create adds a new webhook.
+	Create(w webhook) error
+	// Delete removes a webhook, or returns errWebhookNotFound.
+	Delete(id string) error
+}
+
+// DeliveryStore is the persistence layer for webhook deliveries, with the same memory and bolt backends as BookStore.
+type DeliveryStore interface {
+	// List returns every delivery, oldest first.
+	List() ([]delivery, error)
+	// Get returns the delivery with the given ID, or errDeliveryNotFound.
+	Get(id string) (delivery, error)
+	// Create adds a new delivery.
+	Create(d delivery) error
+	// Update overwrites an existing delivery, or returns errDeliveryNotFound.
+	Update(d delivery) error
+}
+
+// webhooks and deliveries hold the subscriptions and their deliveries. They are chosen in main alongside store.
+var (
+	webhooks   WebhookStore
+	deliveries DeliveryStore
+)
+
+// memoryWebhookStore keeps webhooks in a map, so they are lost when the process exits.
+type memoryWebhookStore struct {
+	mu       sync.RWMutex
+	webhooks map[string]webhook
+}
+
+func newMemoryWebhookStore() *memoryWebhookStore {
+	return &memoryWebhookStore{webhooks: map[string]webhook{}}
+}
+
+func (s *memoryWebhookStore) List() ([]webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]webhook, 0, len(s.webhooks))
+	for _, w := range s.webhooks {
+		list = append(list, w)
+	}
+	sortWebhooks(list)
+	return list, nil
+}
+
+func (s *memoryWebhookStore) Get(id string) (webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w, ok := s.webhooks[id]
+	if !ok {
+		return webhook{}, errWebhookNotFound
+	}
+	return w, nil
+}
+
+func (s *memoryWebhookStore) Create(w webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks[w.ID] = w
+	return nil
+}
+
+func (s *memoryWebhookStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.webhooks[id]; !ok {
+		return errWebhookNotFound
+	}
+	delete(s.webhooks, id)
+	return nil
+}
+
+// memoryDeliveryStore keeps deliveries in a map, so they are lost when the process exits.
+type memoryDeliveryStore struct {
+	mu         sync.RWMutex
+	deliveries map[string]delivery
+}
+
+func newMemoryDeliveryStore() *memoryDeliveryStore {
+	return &memoryDeliveryStore{deliveries: map[string]delivery{}}
+}
+
+func (s *memoryDeliveryStore) List() ([]delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]delivery, 0, len(s.deliveries))
+	for _, d := range s.deliveries {
+		list = append(list, d)
+	}
+	sortDeliveries(list)
+	return list, nil
+}
+
+func (s *memoryDeliveryStore) Get(id string) (delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return delivery{}, errDeliveryNotFound
+	}
+	return d, nil
+}
+
+func (s *memoryDeliveryStore) Create(d delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+func (s *memoryDeliveryStore) Update(d delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.deliveries[d.ID]; !ok {
+		return errDeliveryNotFound
+	}
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+// sortWebhooks orders webhooks by the time they were created, then by ID.
+func sortWebhooks(list []webhook) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// sortDeliveries orders deliveries by the time they were created, then by ID.
+func sortDeliveries(list []delivery) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// filterDeliveries returns the deliveries for which keep returns true.
+func filterDeliveries(keep func(delivery) bool) ([]delivery, error) {
+	all, err := deliveries.List()
+	if err != nil {
+		return nil, err
+	}
+	list := []delivery{}
+	for _, d := range all {
+		if keep(d) {
+			list = append(list, d)
+		}
+	}
+	return list, nil
+}
+
+// newSecret returns a random 32 byte signing secret, hex encoded.
+func newSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// signPayload returns the X-Library-Signature header for a body sent at the given time:
+// "t=<unix seconds>,sha256=<hex HMAC-SHA256 of "<unix seconds>.<body>" keyed with the secret>".
+// Receivers should recompute it and reject old timestamps to stop replays.
+func signPayload(secret string, at time.Time, body []byte) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookWake nudges the delivery worker when new deliveries are queued, so they do not wait for its next tick.
+var webhookWake = make(chan struct{}, 1)
+
+// notifyWebhooks queues a delivery of the event for every webhook subscribed to its type.
+// Deliveries are made in the background by deliverWebhooks, so a slow receiver never holds up a request.
+func notifyWebhooks(e event) {
+	subs, err := webhooks.List()
+	if err != nil {
+		log.Printf("Error listing webhooks for %s event: %v", e.Type, err)
+		return
+	}
+	var payload []byte
+	queued := false
+	for _, w := range subs {
+		if !w.wants(e.Type) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(e); err != nil {
+				log.Printf("Error encoding %s event for webhooks: %v", e.Type, err)
+				return
+			}
+		}
+		now := time.Now().UTC()
+		d := delivery{ID: newID(), WebhookID: w.ID, Event: e.Type, Payload: payload, Status: deliveryPending, CreatedAt: now, NextAttemptAt: now}
+		if err := deliveries.Create(d); err != nil {
+			log.Printf("Error queueing %s delivery to webhook %s: %v", e.Type, w.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		wakeDeliveries()
+	}
+}
+
+// notifyIfBackInStock sends a book.available webhook for a logged event that put a copy on the shelf
+// of a book that had none there, which is when the book's Quantity, its count of copies on the shelf, is now 1.
+func notifyIfBackInStock(e event) {
+	if e.Book == nil || e.Item == nil || e.Item.Status != itemAvailable || e.Book.Quantity != 1 {
+		return
+	}
+	e.Type = eventBookAvailable
+	notifyWebhooks(e)
+}
+
+// wakeDeliveries tells deliverWebhooks that there is work to do, without waiting if it has already been told.
+func wakeDeliveries() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookSenders is how many deliveries are sent at once. Each webhook has at most one delivery in flight,
+// so a receiver that is slow or down only holds up its own deliveries, and the others go out meanwhile.
+const webhookSenders = 8
+
+// deliverWebhooks sends due deliveries whenever new ones are queued and at least once per interval. When ctx is cancelled
+// it stops taking up deliveries and returns once those in flight are saved; any left pending are sent on the next start.
+// Deliveries left pending by an earlier run of a bolt-backed server are picked up again on the first tick.
+func deliverWebhooks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var mu sync.Mutex
+	busy := map[string]bool{} // webhooks with a delivery in flight
+	senders := make(chan struct{}, webhookSenders)
+	var sending sync.WaitGroup
+	defer sending.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+		due, err := filterDeliveries(func(d delivery) bool {
+			return d.Status == deliveryPending && !d.NextAttemptAt.After(time.Now())
+		})
+		if err != nil {
+			log.Printf("Error listing webhook deliveries: %v", err)
+			continue
+		}
+	dispatch:
+		for _, d := range due {
+			mu.Lock()
+			if busy[d.WebhookID] {
+				mu.Unlock()
+				continue
+			}
+			// Deliveries that find every sender busy wait for the wake-up the next sender to finish sends.
+			select {
+			case senders <- struct{}{}:
+			default:
+				mu.Unlock()
+				break dispatch
+			}
+			busy[d.WebhookID] = true
+			mu.Unlock()
+			sending.Add(1)
+			go func(d delivery) {
+				defer sending.Done()
+				attemptDelivery(d)
+				mu.Lock()
+				delete(busy, d.WebhookID)
+				mu.Unlock()
+				<-senders
+				wakeDeliveries()
+			}(d)
+		}
+	}
+}
+
+// attemptDelivery sends a delivery once and records the outcome. A 2xx response delivers it; anything else schedules
+// a retry with exponential backoff, or makes it a dead letter after maxDeliveryAttempts.
+func attemptDelivery(d delivery) {
+	d.Attempts++
+	w, err := webhooks.Get(d.WebhookID)
+	if err == nil {
+		d.LastStatus, err = postDelivery(w, d)
+	}
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		d.Status = deliveryDelivered
+		d.LastError = ""
+		d.DeliveredAt = &now
+	case errors.Is(err, errWebhookNotFound):
+		d.Status = deliveryDead
+		d.LastError = "webhook was deleted"
+	default:
+		d.LastError = err.Error()
+		if d.Attempts >= maxDeliveryAttempts {
+			d.Status = deliveryDead
+		} else {
+			d.NextAttemptAt = now.Add(webhookRetryBase << (d.Attempts - 1))
+		}
+	}
+	if err := deliveries.Update(d); err != nil {
+		log.Printf("Error saving webhook delivery %s: %v", d.ID, err)
+	}
+}
+
+// postDelivery POSTs the payload to the webhook and returns the response status.
+// It returns an error if the request fails or the status is not 2xx.
+func postDelivery(w webhook, d delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "library-webhooks/1")
+	req.Header.Set("X-Library-Event", d.Event)
+	req.Header.Set("X-Library-Delivery", d.ID)
+	req.Header.Set("X-Library-Signature", signPayload(w.Secret, time.Now(), d.Payload))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("receiver answered " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// validWebhookEvent reports whether t is one of webhookEvents.
+func validWebhookEvent(t string) bool {
+	for _, e := range webhookEvents {
+		if t == e {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookInput is the body accepted when creating a webhook. The secret is generated if it is left out.
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// validate checks the webhook input and returns the problems found, keyed by field.
+func (in webhookInput) validate() map[string]string {
+	problems := map[string]string{}
+	if u, err := url.Parse(in.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems["url"] = "must be an absolute http or https URL"
+	}
+	if len(in.Events) == 0 {
+		problems["events"] = "must list at least one of " + strings.Join(webhookEvents, ", ")
+	}
+	for _, t := range in.Events {
+		if !validWebhookEvent(t) {
+			problems["events"] = "must only contain " + strings.Join(webhookEvents, ", ")
+		}
+	}
+	if in.Secret != "" && len(in.Secret) < 16 {
+		problems["secret"] = "must be at least 16 characters"
+	}
+	return problems
+}
+
+// respondWebhookError writes the HTTP response for an error returned by the webhook or delivery store.
+func respondWebhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errWebhookNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Webhook not found."})
+	case errors.Is(err, errDeliveryNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Delivery not found."})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not load webhooks."})
+	}
+}
+
+// createWebhook handles POST /webhooks. The response is the only place the signing secret is shown.
+func createWebhook(c *gin.Context) {
+	var input webhookInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Request body must be a JSON webhook."})
+		return
+	}
+	if problems := input.validate(); len(problems) > 0 {
+		respondValidationErrors(c, problems)
+		return
+	}
+	if input.Secret == "" {
+		input.Secret = newSecret()
+	}
+	w := webhook{ID: newID(), URL: input.URL, Events: input.Events, Secret: input.Secret, CreatedAt: time.Now().UTC()}
+	if err := webhooks.Create(w); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Could not create webhook."})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, w)
+}
+
+// listWebhooks handles GET /webhooks.
+func listWebhooks(c *gin.Context) {
+	list, err := webhooks.List()
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	for i := range list {
+		list[i] = list[i].withoutSecret()
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// getWebhook handles GET /webhooks/:id.
+func getWebhook(c *gin.Context) {
+	w, err := webhooks.Get(c.Param("id"))
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, w.withoutSecret())
+}
+
+// deleteWebhook handles DELETE /webhooks/:id. Deliveries still pending for it become dead letters.
+func deleteWebhook(c *gin.Context) {
+	if err := webhooks.Delete(c.Param("id")); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listDeliveries handles GET /webhooks/:id/deliveries?status=pending|delivered|dead.
+func listDeliveries(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := webhooks.Get(id); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	respondDeliveries(c, func(d delivery) bool {
+		return d.WebhookID == id
+	})
+}
+
+// deadLetters handles GET /deliveries/dead and lists every delivery that ran out of attempts, across all webhooks.
+func deadLetters(c *gin.Context) {
+	list, err := filterDeliveries(func(d delivery) bool {
+		return d.Status == deliveryDead
+	})
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// respondDeliveries writes the deliveries for which keep returns true, filtered by the optional status query parameter.
+func respondDeliveries(c *gin.Context, keep func(delivery) bool) {
+	status := c.Query("status")
+	switch status {
+	case "", deliveryPending, deliveryDelivered, deliveryDead:
+	default:
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "status must be pending, delivered or dead"})
+		return
+	}
+	list, err := filterDeliveries(func(d delivery) bool {
+		return keep(d) && (status == "" || d.Status == status)
+	})
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// redeliver handles POST /deliveries/:id/redeliver and queues a dead or delivered delivery to be sent again,
+// with a fresh set of attempts. The webhook must still exist.
+func redeliver(c *gin.Context) {
+	d, err := deliveries.Get(c.Param("id"))
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	if d.Status == deliveryPending {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Delivery is already queued."})
+		return
+	}
+	if _, err := webhooks.Get(d.WebhookID); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	d.Status = deliveryPending
+	d.Attempts = 0
+	d.LastError = ""
+	d.NextAttemptAt = time.Now().UTC()
+	if err := deliveries.Update(d); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	wakeDeliveries()
+	c.IndentedJSON(http.StatusAccepted, d)
+}
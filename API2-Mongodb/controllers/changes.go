@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"github.com/alaiy95/golang-projects/api2-mongodb/repository"
+	"github.com/julienschmidt/httprouter"
+)
+
+// changesKeepAlive is how often GET /users/changes sends a comment while there are no changes,
+// so that proxies do not close the connection as idle
+const changesKeepAlive = 15 * time.Second
+
+// The WatchUsers method streams changes to users as Server-Sent Events. Each event is named after the type of change
+// (create, update, delete, restore or purge) and its data is the change as JSON. The event id resumes the stream
+// right after the event: EventSource sends it back in the Last-Event-ID header when it reconnects, and other clients
+// can pass it as ?after=. If the changes after it are no longer kept the response is 410 Gone, and the client
+// should fetch the users again and watch from now on.
+func (uc *UserController) WatchUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Streaming is not supported")
+		return
+	}
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream, err := uc.repo.Watch(ctx, after)
+	if errors.Is(err, repository.ErrUnknownResumeToken) {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprint(w, "Changes after this event are no longer available")
+		return
+	} else if err != nil {
+		log.Printf("Error watching users: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Next blocks until there is a change, so it is called from its own goroutine while this one sends keep-alives.
+	// The stream is only closed once that goroutine has stopped.
+	changes := make(chan models.UserChange)
+	failed := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			change, err := stream.Next(ctx)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+		stream.Close(context.Background())
+	}()
+
+	keepAlive := time.NewTicker(changesKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case change := <-changes:
+			data, err := json.Marshal(change)
+			if err != nil {
+				log.Printf("Error encoding change as JSON: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", change.Token, change.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case err := <-failed:
+			// Ending the response makes EventSource reconnect from the last event it received
+			if ctx.Err() == nil {
+				log.Printf("Error watching users: %v", err)
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read from GET /users/changes
+type sseEvent struct {
+	ID, Type, Data string
+}
+
+// newTestServer serves newTestRouter over HTTP until the test ends, after the streams opened by watchChanges are closed
+func newTestServer(t *testing.T) (http.Handler, *httptest.Server) {
+	h := newTestRouter(time.Hour)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return h, srv
+}
+
+// watchChanges opens GET /users/changes with the given Last-Event-ID, which may be empty, and returns the response.
+// The stream is closed when the test ends.
+func watchChanges(t *testing.T, srv *httptest.Server, lastEventID string) *http.Response {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/users/changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readEvents reads n events from a stream, skipping keep-alive comments
+func readEvents(t *testing.T, resp *http.Response, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var e sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.ID != "" {
+				events = append(events, e)
+			}
+			e = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			e.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("got %d events, want %d: %v", len(events), n, scanner.Err())
+	}
+	return events
+}
+
+func TestWatchUsersStreamsAndResumes(t *testing.T) {
+	h, srv := newTestServer(t)
+
+	live := watchChanges(t, srv, "")
+	if live.StatusCode != http.StatusOK || live.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %d %s, want 200 text/event-stream", live.StatusCode, live.Header.Get("Content-Type"))
+	}
+	ann := createUser(t, h, "Ann", 30)
+	createUser(t, h, "Bob", 40)
+	if w := serve(h, http.MethodDelete, "/user/"+ann.Id.Hex(), ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d", w.Code)
+	}
+	events := readEvents(t, live, 3)
+	for i, want := range []string{"create", "create", "delete"} {
+		if events[i].Type != want {
+			t.Errorf("event %d: got %s, want %s", i, events[i].Type, want)
+		}
+	}
+	if !strings.Contains(events[0].Data, ann.Id.Hex()) {
+		t.Errorf("first event is not about the first user: %s", events[0].Data)
+	}
+
+	resumed := watchChanges(t, srv, events[0].ID)
+	if resumed.StatusCode != http.StatusOK {
+		t.Fatalf("resuming: got %d, want 200", resumed.StatusCode)
+	}
+	again := readEvents(t, resumed, 2)
+	if again[0] != events[1] || again[1] != events[2] {
+		t.Errorf("resuming after the first event: got %v, want %v", again, events[1:])
+	}
+}
+
+func TestWatchUsersUnknownResumeToken(t *testing.T) {
+	h, srv := newTestServer(t)
+	createUser(t, h, "Ann", 30)
+
+	for _, token := range []string{"12345", "not-a-token"} {
+		resp := watchChanges(t, srv, token)
+		if resp.StatusCode != http.StatusGone {
+			t.Errorf("Last-Event-ID %q: got %d, want 410", token, resp.StatusCode)
+		}
+	}
+}
+
+func TestWatchUsersExpiredResumeToken(t *testing.T) {
+	h, srv := newTestServer(t)
+
+	live := watchChanges(t, srv, "")
+	createUser(t, h, "Ann", 30)
+	first := readEvents(t, live, 1)[0]
+	// The memory repository keeps the last 1000 changes. Resuming after the first needs the second,
+	// which is dropped once 1001 more changes are made.
+	for i := 0; i < 1001; i++ {
+		createUser(t, h, "Bob", 40)
+	}
+
+	resp := watchChanges(t, srv, first.ID)
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("got %d, want 410", resp.StatusCode)
+	}
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"github.com/alaiy95/golang-projects/api2-mongodb/repository"
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Limits of POST /users/import
+const (
+	importBatchSize   = 1000    // users inserted per CreateMany call
+	maxImportLineSize = 1 << 20 // bytes in one line of the body
+)
+
+// ImportResult reports what happened to one line of an import
+type ImportResult struct {
+	Line    int                 `json:"line"`
+	Status  string              `json:"status"` // created or failed
+	ID      *primitive.ObjectID `json:"id,omitempty"`
+	Message string              `json:"message,omitempty"`
+	Errors  []models.FieldError `json:"errors,omitempty"`
+}
+
+// ImportReport is the last line of the response to POST /users/import. Error is set if the import stopped before
+// the end of the body; the lines after the last result were not read.
+type ImportReport struct {
+	Created int    `json:"created"`
+	Failed  int    `json:"failed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// userImport is an import in progress. Valid users wait in batch until there are importBatchSize of them, and results
+// wait in results until their batch is stored, so that they are written in line order.
+type userImport struct {
+	uc      *UserController
+	ctx     context.Context
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	report  ImportReport
+	results []ImportResult
+	batch   []models.User
+	lines   []int // the index in results of each user in batch
+	gone    bool  // the response could not be written, so nothing more is sent
+}
+
+// The ImportUsers method creates users in bulk from an NDJSON (application/x-ndjson) body with one user per line,
+// as sent to POST /user. The body is read line by line and inserted in batches, so it is never held in memory as a whole.
+// Each line is checked like a POST /user; an invalid line is reported and does not stop the others. A line may give
+// the user's id, to keep IDs from another system; a line whose id is already taken fails. Blank lines are skipped.
+// The response is NDJSON too: one ImportResult per line of the body, in order and written as each batch is stored,
+// then an ImportReport with the totals. The import stops if the client goes away.
+func (uc *UserController) ImportUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/jsonlines":
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprint(w, "Imports must be application/x-ndjson, one JSON user per line")
+		return
+	}
+
+	// Results are written while the body is still being read. HTTP/1 needs to be told that is intended;
+	// HTTP/2 always allows it and returns an error that can be ignored.
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	imp := &userImport{uc: uc, ctx: r.Context(), w: w, rc: rc}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if !imp.add(line, text) {
+			imp.finish()
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		imp.report.Error = "Could not read the body: " + err.Error()
+		if errors.Is(err, bufio.ErrTooLong) {
+			imp.report.Error = fmt.Sprintf("Line %d is longer than %d bytes", line+1, maxImportLineSize)
+		}
+	}
+	imp.flush()
+	imp.finish()
+}
+
+// add checks one line of the import and queues the user for the next batch, storing the batch once it is full.
+// It returns false if the import has to stop.
+func (imp *userImport) add(line int, text []byte) bool {
+	u := models.User{}
+	if err := json.Unmarshal(text, &u); err != nil {
+		return imp.fail(ImportResult{Line: line, Message: "Error decoding line: " + err.Error()})
+	}
+	if errs := u.Validate(); errs != nil {
+		return imp.fail(ImportResult{Line: line, Message: "Invalid user", Errors: errs})
+	}
+
+	// Unlike CreateUser, an ID given on the line is kept. The user is never already deleted.
+	if u.Id.IsZero() {
+		u.Id = primitive.NewObjectID()
+	}
+	u.DeletedAt = nil
+	imp.lines = append(imp.lines, len(imp.results))
+	imp.results = append(imp.results, ImportResult{Line: line})
+	imp.batch = append(imp.batch, u)
+	if len(imp.batch) < importBatchSize {
+		return true
+	}
+	return imp.flush()
+}
+
+// fail records a line that was not imported. It returns false if the import has to stop.
+func (imp *userImport) fail(result ImportResult) bool {
+	result.Status = "failed"
+	imp.results = append(imp.results, result)
+	imp.report.Failed++
+	// Failed lines are written out once there are as many as a batch, so that a body of bad lines is not held either
+	if len(imp.results) < importBatchSize {
+		return true
+	}
+	return imp.flush()
+}
+
+// flush stores the waiting batch, fills in its results and writes out every waiting result.
+// It returns false if the batch failed as a whole or the results could not be written.
+func (imp *userImport) flush() bool {
+	ok := imp.store()
+	for _, result := range imp.results {
+		if !imp.write(result) {
+			return false
+		}
+	}
+	imp.results = imp.results[:0]
+	if err := imp.rc.Flush(); err != nil {
+		log.Printf("Error sending import results: %v", err)
+		imp.gone = true
+		return false
+	}
+	return ok
+}
+
+// store inserts the waiting batch and fills in its results. It returns false if the batch failed as a whole.
+func (imp *userImport) store() bool {
+	if len(imp.batch) == 0 {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(imp.ctx, 30*time.Second)
+	defer cancel()
+	errs, err := imp.uc.repo.CreateMany(ctx, imp.batch)
+	if err != nil {
+		log.Printf("Error importing users: %v", err)
+		imp.report.Error = "Could not store users"
+	}
+	for i, u := range imp.batch {
+		result := &imp.results[imp.lines[i]]
+		switch {
+		case err != nil:
+			result.Status, result.Message = "failed", "Could not store the batch; the user may or may not have been created"
+			imp.report.Failed++
+		case errors.Is(errs[i], repository.ErrDuplicateID):
+			result.Status, result.Message = "failed", "A user with this ID already exists"
+			imp.report.Failed++
+		case errs[i] != nil:
+			log.Printf("Error importing user on line %d: %v", result.Line, errs[i])
+			result.Status, result.Message = "failed", "Could not create user"
+			imp.report.Failed++
+		default:
+			id := u.Id
+			result.Status, result.ID = "created", &id
+			imp.report.Created++
+		}
+	}
+	imp.batch, imp.lines = imp.batch[:0], imp.lines[:0]
+	return err == nil
+}
+
+// finish writes the ImportReport as the last line of the response, unless the client is gone
+func (imp *userImport) finish() {
+	if !imp.gone {
+		imp.write(imp.report)
+	}
+}
+
+// write sends v as one line of the response. It returns false if the client can no longer be written to.
+func (imp *userImport) write(v interface{}) bool {
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding import result as JSON: %v", err)
+		return false
+	}
+	if _, err := imp.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Error sending import results: %v", err)
+		imp.gone = true
+		return false
+	}
+	return true
+}
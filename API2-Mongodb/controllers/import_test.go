@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importUsers sends body to POST /users/import and returns the per-line results and the closing report
+func importUsers(t *testing.T, h http.Handler, body string) ([]ImportResult, ImportReport) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/users/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("got %d %s, want 200 application/x-ndjson: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	results := make([]ImportResult, len(lines)-1)
+	for i, line := range lines[:len(lines)-1] {
+		if err := json.Unmarshal([]byte(line), &results[i]); err != nil {
+			t.Fatalf("result %d: %v", i, err)
+		}
+	}
+	var report ImportReport
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &report); err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	return results, report
+}
+
+func TestImportUsersMixedLines(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	existing := createUser(t, h, "Ann", 30)
+	const id = "64b7f0c2e4b0a1a2b3c4d5e6"
+	body := strings.Join([]string{
+		`{"name": "Bob", "gender": "male", "age": 40}`,
+		`{"name": "Cy"`,
+		`{"id": "` + id + `", "name": "Di", "gender": "female", "age": 50}`,
+		``,
+		`{"name": "Ed", "gender": "unknown", "age": 60}`,
+		`{"id": "` + id + `", "name": "Fay", "gender": "female", "age": 70}`,
+		`{"id": "` + existing.Id.Hex() + `", "name": "Gus", "gender": "male", "age": 80}`,
+	}, "\n")
+
+	results, report := importUsers(t, h, body)
+	want := []struct {
+		line   int
+		status string
+	}{{1, "created"}, {2, "failed"}, {3, "created"}, {5, "failed"}, {6, "failed"}, {7, "failed"}}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		if results[i].Line != w.line || results[i].Status != w.status {
+			t.Errorf("result %d: got line %d %s, want line %d %s", i, results[i].Line, results[i].Status, w.line, w.status)
+		}
+	}
+	if results[2].ID == nil || results[2].ID.Hex() != id {
+		t.Errorf("line 3: got ID %v, want the one given, %s", results[2].ID, id)
+	}
+	if len(results[3].Errors) != 1 || results[3].Errors[0].Field != "gender" {
+		t.Errorf("line 5: got errors %+v, want one for gender", results[3].Errors)
+	}
+	for _, r := range results[4:] {
+		if r.Message != "A user with this ID already exists" {
+			t.Errorf("line %d: got message %q, want a duplicate ID", r.Line, r.Message)
+		}
+	}
+	if report != (ImportReport{Created: 2, Failed: 4}) {
+		t.Errorf("got report %+v, want 2 created and 4 failed", report)
+	}
+
+	w := serve(h, http.MethodGet, "/user/"+id, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Di"`) {
+		t.Errorf("GET the imported user: got %d %s, want the first user with that ID", w.Code, w.Body)
+	}
+	w = serve(h, http.MethodGet, "/user/"+existing.Id.Hex(), "")
+	if !strings.Contains(w.Body.String(), `"Ann"`) {
+		t.Errorf("the existing user was overwritten: %s", w.Body)
+	}
+}
+
+func TestImportUsersInBatches(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	var body strings.Builder
+	const n = 2*importBatchSize + 500
+	for i := 1; i <= n; i++ {
+		if i%1000 == 7 {
+			body.WriteString("not json\n")
+			continue
+		}
+		fmt.Fprintf(&body, `{"name": "User %d", "gender": "other", "age": %d}`+"\n", i, i%100)
+	}
+
+	results, report := importUsers(t, h, body.String())
+	if len(results) != n {
+		t.Fatalf("got %d results, want %d", len(results), n)
+	}
+	for i, r := range results {
+		if r.Line != i+1 {
+			t.Fatalf("result %d is for line %d, want results in line order", i, r.Line)
+		}
+	}
+	if report != (ImportReport{Created: n - 3, Failed: 3}) {
+		t.Errorf("got report %+v, want %d created and 3 failed", report, n-3)
+	}
+}
+
+func TestImportUsersStreamsResults(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(time.Hour))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first batch's results must arrive while the rest of the body has not been sent.
+	// The body ends once they have, or when the test times out.
+	body, send := io.Pipe()
+	resultsRead := make(chan struct{})
+	go func() {
+		for i := 0; i < importBatchSize; i++ {
+			fmt.Fprintf(send, `{"name": "User %d", "gender": "other", "age": 20}`+"\n", i)
+		}
+		select {
+		case <-resultsRead:
+		case <-ctx.Done():
+		}
+		send.Close()
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/users/import", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for i := 0; i < importBatchSize; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("got %d results before the body ended, want %d: %v", i, importBatchSize, scanner.Err())
+		}
+	}
+	close(resultsRead)
+	if !scanner.Scan() {
+		t.Fatal("no report after the body ended")
+	}
+	var report ImportReport
+	if err := json.Unmarshal(scanner.Bytes(), &report); err != nil || report.Created != importBatchSize {
+		t.Errorf("got report %s, want %d created", scanner.Bytes(), importBatchSize)
+	}
+}
+
+func TestImportUsersRejectsOtherContentTypes(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	w := serve(h, http.MethodPost, "/users/import", `{"name": "Ann", "gender": "female", "age": 30}`)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got %d, want 415", w.Code)
+	}
+}
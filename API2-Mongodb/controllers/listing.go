@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+)
+
+// Page sizes for GET /users
+const (
+	defaultUserLimit = 50
+	maxUserLimit     = 500
+)
+
+// ParseUserQuery reads the GET /users query parameters:
+//
+//	gender              exact gender
+//	min_age, max_age    inclusive age range
+//	name                name prefix, case-sensitive so the name index can be used
+//	include_deleted     true to list deleted users too, until they are purged
+//	sort                id (default), name, gender or age, prefixed with - for descending order
+//	limit               page size, 1 to 500
+//	cursor              next_cursor from the previous page, with the same sort and filters
+func ParseUserQuery(v url.Values) (models.UserQuery, error) {
+	q := models.UserQuery{
+		Gender:     v.Get("gender"),
+		NamePrefix: v.Get("name"),
+		Limit:      defaultUserLimit,
+	}
+	for name, target := range map[string]**int{"min_age": &q.MinAge, "max_age": &q.MaxAge} {
+		if s := v.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return q, errors.New(name + " must be a non-negative integer")
+			}
+			*target = &n
+		}
+	}
+	if q.MinAge != nil && q.MaxAge != nil && *q.MinAge > *q.MaxAge {
+		return q, errors.New("min_age must not be greater than max_age")
+	}
+	var err error
+	if q.IncludeDeleted, err = parseIncludeDeleted(v); err != nil {
+		return q, err
+	}
+
+	sortParam := v.Get("sort")
+	if sortParam == "" {
+		sortParam = "id"
+	}
+	q.SortField = strings.TrimPrefix(sortParam, "-")
+	q.Desc = strings.HasPrefix(sortParam, "-")
+	switch q.SortField {
+	case "id", "name", "gender", "age":
+	default:
+		return q, errors.New("sort must be id, name, gender or age, optionally prefixed with -")
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxUserLimit {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(maxUserLimit))
+		}
+		q.Limit = n
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		cur, err := models.DecodeUserCursor(s)
+		if err != nil || cur.Sort != sortParam || cur.Filter != q.FilterParam() {
+			return q, errors.New("cursor is invalid or was made for a different sort or filters")
+		}
+		q.After = &cur
+	}
+	return q, nil
+}
+
+// parseIncludeDeleted reads the include_deleted query parameter, which makes GET /users and GET /user/:id show deleted users
+func parseIncludeDeleted(v url.Values) (bool, error) {
+	s := v.Get("include_deleted")
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.New("include_deleted must be true or false")
+	}
+	return b, nil
+}
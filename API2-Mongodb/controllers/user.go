@@ -3,80 +3,99 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/alaiy95/golang-projects/api2-mongodb/models"
-	"github.com/google/uuid"
+	"github.com/alaiy95/golang-projects/api2-mongodb/repository"
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Define a UserController struct to hold a reference to a MongoDB client
+// Define a UserController struct to hold a reference to the repository users are stored in
 type UserController struct {
-	client *mongo.Client
+	repo repository.UserRepository
 }
 
 // Define the NewUserController function to create a new UserController instance
-func NewUserController(client *mongo.Client) *UserController {
-	return &UserController{client}
+func NewUserController(repo repository.UserRepository) *UserController {
+	return &UserController{repo}
 }
 
-func (uc *UserController) GetUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// Extract the ID parameter from the request parameters
+// parseUserID converts the ":id" route parameter to the ObjectID that CreateUser stored as the user's "_id".
+// Every handler that takes a user ID goes through it, so IDs are handled the same way everywhere.
+// If the parameter is not a 24-character hexadecimal ObjectID it writes a 400 Bad Request response and returns false.
+func parseUserID(w http.ResponseWriter, p httprouter.Params) (primitive.ObjectID, bool) {
 	id := p.ByName("id")
-
-	// Check if the ID parameter is a valid hexadecimal string
-	if !primitive.IsValidHexID(id) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
 		log.Printf("Invalid ObjectID provided: %v", id)
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid user ID")
+		return primitive.NilObjectID, false
+	}
+	return oid, true
+}
+
+// writeJSON sets the response headers and writes v as a JSON-encoded response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	uj, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding response as JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", uj)
+}
 
-	// Convert the ID string to a MongoDB ObjectID
-	oid, err := primitive.ObjectIDFromHex(id)
+// writeValidationErrors writes a 422 Unprocessable Entity response listing every field that breaks the rules
+func writeValidationErrors(w http.ResponseWriter, errs []models.FieldError) {
+	writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"errors": errs})
+}
+
+// writeNotFound writes the 404 Not Found response for a user ID that matches no user
+func writeNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, "User not found")
+}
+
+// The GetUser method retrieves a single user from the database by ID.
+// Deleted users are only returned with ?include_deleted=true.
+func (uc *UserController) GetUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Extract the ID parameter from the request parameters and convert it to a MongoDB ObjectID
+	oid, ok := parseUserID(w, p)
+	if !ok {
+		return
+	}
+	includeDeleted, err := parseIncludeDeleted(r.URL.Query())
 	if err != nil {
-		log.Printf("Error parsing ObjectID from request parameter: %v", err)
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
 		return
 	}
-	log.Printf("Converted ID parameter to ObjectID: %v\n", oid)
 
 	// Create a context with a timeout of 5 seconds
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Retrieve a user with that ID from the "users" collection in the "mongo-golang" database
-	u := models.User{}
-	filter := bson.M{"_id": oid}
-	err = uc.client.Database("mongo-golang").Collection("users").FindOne(ctx, filter).Decode(&u)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Printf("Error retrieving user: %v", err)
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		log.Printf("Error retrieving user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// Retrieve the user with that ID from the repository
+	u, err := uc.repo.Get(ctx, oid)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && u.IsDeleted() && !includeDeleted) {
+		writeNotFound(w)
 		return
-	}
-
-	// Marshal the retrieved user object into a JSON-encoded byte slice
-	uj, err := json.Marshal(u)
-	if err != nil {
-		log.Printf("Error encoding user as JSON: %v", err)
+	} else if err != nil {
+		log.Printf("Error retrieving user: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Set the response headers and write the JSON-encoded user object to the response body
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s\n", uj)
+	// Write the user object as the JSON response body
+	writeJSON(w, http.StatusOK, u)
 }
 
 // The CreateUser method creates a new user in the database
@@ -90,62 +109,175 @@ func (uc *UserController) CreateUser(w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
+	// Check the user against the rules on models.User and report every broken rule at once
+	if errs := u.Validate(); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
 	// Create a context with a timeout of 5 seconds
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Generate a new MongoDB ObjectID for the user and set the user's ID field
-	log.Println("Before generating ObjectID")
+	// Generate a new MongoDB ObjectID for the user and set the user's ID field.
+	// Only DeleteUser sets deleted_at, so any value in the request body is ignored.
 	u.Id = primitive.NewObjectID()
-	log.Printf("Generated ObjectID: %s\n", u.Id.Hex())
+	u.DeletedAt = nil
 
-	// Insert the user into the "users" collection in the "mongo-golang" database
-	_, err1 := uc.client.Database("mongo-golang").Collection("users").InsertOne(ctx, u)
-	if err1 != nil {
+	// Store the user in the repository
+	if err := uc.repo.Create(ctx, u); err != nil {
+		log.Printf("Error creating user: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Marshal the inserted user object into a JSON-encoded byte slice
-	uj, err := json.Marshal(u)
-	if err != nil {
+	// Write the inserted user object as the JSON response body
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// The DeleteUser method deletes a user by ID. The user is only marked as deleted, and can be restored with RestoreUser
+// until the retention period has passed and it is purged.
+func (uc *UserController) DeleteUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	oid, ok := parseUserID(w, p)
+	if !ok {
+		return
+	}
+
+	err := uc.repo.Delete(ctx, oid)
+	if errors.Is(err, repository.ErrNotFound) {
+		writeNotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error deleting user: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error marshaling user: %s", err.Error())
+		fmt.Fprint(w, "Error deleting user")
 		return
 	}
 
-	// Set the response headers and write the JSON-encoded user object to the response body
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "%s\n", uj)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "User deleted successfully")
 }
 
-// The DeleteUser method deletes a user from the database by ID
-func (uc *UserController) DeleteUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+// The ListUsers method returns a page of users as JSON, filtered and sorted by the query parameters (see listing.go).
+// Pages are fetched by cursor rather than by offset, so later pages cost the same as the first however large the collection grows.
+func (uc *UserController) ListUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q, err := ParseUserQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	id := p.ByName("id")
-	if _, err := uuid.Parse(id); err != nil {
+	page, err := uc.repo.List(ctx, q)
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// The UpdateUser method replaces the name, gender and age of an existing user. Deleted users must be restored first.
+// The ID comes from the path; any id or deleted_at in the request body is ignored.
+func (uc *UserController) UpdateUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	oid, ok := parseUserID(w, p)
+	if !ok {
+		return
+	}
+
+	u := models.User{}
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid user ID")
+		fmt.Fprintf(w, "Error decoding request body: %s", err.Error())
+		return
+	}
+	u.Id = oid
+	u.DeletedAt = nil
+	if errs := u.Validate(); errs != nil {
+		writeValidationErrors(w, errs)
 		return
 	}
 
-	collection := uc.client.Database("mongo-golang").Collection("users")
-	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := uc.repo.Replace(ctx, u)
+	if errors.Is(err, repository.ErrNotFound) {
+		writeNotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error replacing user: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Error deleting user")
 		return
 	}
 
-	if result.DeletedCount == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "User not found")
+	writeJSON(w, http.StatusOK, u)
+}
+
+// The PatchUser method changes only the fields present in the request body and returns the updated user.
+// Deleted users must be restored first.
+func (uc *UserController) PatchUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	oid, ok := parseUserID(w, p)
+	if !ok {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "User deleted successfully")
+	// Unknown fields, including id, are rejected so a typo is not silently ignored
+	patch := models.UserPatch{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error decoding request body: %s", err.Error())
+		return
+	}
+	if errs := patch.Validate(); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	u, err := uc.repo.Patch(ctx, oid, patch)
+	if errors.Is(err, repository.ErrNotFound) {
+		writeNotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error updating user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+// The RestoreUser method undoes DeleteUser and returns the restored user, as long as the user has not been purged yet
+func (uc *UserController) RestoreUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	oid, ok := parseUserID(w, p)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	u, err := uc.repo.Restore(ctx, oid)
+	if errors.Is(err, repository.ErrNotFound) {
+		writeNotFound(w)
+		return
+	} else if err != nil {
+		log.Printf("Error restoring user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
 }
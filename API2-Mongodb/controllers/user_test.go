@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"github.com/alaiy95/golang-projects/api2-mongodb/repository"
+	"github.com/julienschmidt/httprouter"
+)
+
+// newTestRouter returns the routes from main.go backed by an empty memory repository
+func newTestRouter(retention time.Duration) http.Handler {
+	uc := NewUserController(repository.NewMemoryUserRepository(retention))
+	r := httprouter.New()
+	r.GET("/users", uc.ListUsers)
+	r.GET("/users/changes", uc.WatchUsers)
+	r.POST("/users/import", uc.ImportUsers)
+	r.GET("/user/:id", uc.GetUser)
+	r.POST("/user", uc.CreateUser)
+	r.PUT("/user/:id", uc.UpdateUser)
+	r.PATCH("/user/:id", uc.PatchUser)
+	r.DELETE("/user/:id", uc.DeleteUser)
+	r.POST("/user/:id/restore", uc.RestoreUser)
+	return r
+}
+
+// serve sends a request with the given body, which may be empty, and returns the recorded response
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// createUser creates a user through POST /user and returns it as stored
+func createUser(t *testing.T, h http.Handler, name string, age int) models.User {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "gender": "other", "age": age})
+	w := serve(h, http.MethodPost, "/user", string(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /user: got %d %s, want 201", w.Code, w.Body)
+	}
+	var u models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatalf("POST /user: %v", err)
+	}
+	return u
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	created := createUser(t, h, "Ann", 30)
+	if created.Id.IsZero() {
+		t.Fatal("created user has no ID")
+	}
+
+	w := serve(h, http.MethodGet, "/user/"+created.Id.Hex(), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /user/:id: got %d, want 200", w.Code)
+	}
+	var got models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != created.Id || got.Name != "Ann" || got.Age != 30 {
+		t.Errorf("GET /user/:id: got %+v, want %+v", got, created)
+	}
+}
+
+func TestCreateUserRejectsInvalidUser(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	w := serve(h, http.MethodPost, "/user", `{"name": "", "gender": "unknown", "age": 200}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want 422", w.Code)
+	}
+	var body struct {
+		Errors []models.FieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Errors) != 3 {
+		t.Errorf("got %d field errors, want 3: %s", len(body.Errors), w.Body)
+	}
+}
+
+func TestGetUserUnknownAndInvalidID(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	if w := serve(h, http.MethodGet, "/user/000000000000000000000000", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown ID: got %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/user/nope", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid ID: got %d, want 400", w.Code)
+	}
+}
+
+func TestListUsersCursorPaging(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	for i := 0; i < 5; i++ {
+		createUser(t, h, string(rune('A'+i))+"nn", 20+i)
+	}
+
+	var names []string
+	target := "/users?sort=-age&limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages == 5 {
+			t.Fatal("paging did not stop")
+		}
+		w := serve(h, http.MethodGet, target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d %s", target, w.Code, w.Body)
+		}
+		var page models.UserPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) > 2 {
+			t.Fatalf("GET %s: got %d users, want at most 2", target, len(page.Users))
+		}
+		for _, u := range page.Users {
+			names = append(names, u.Name)
+		}
+		target = ""
+		if page.NextCursor != "" {
+			target = "/users?sort=-age&limit=2&cursor=" + page.NextCursor
+		}
+	}
+	if got := strings.Join(names, ","); got != "Enn,Dnn,Cnn,Bnn,Ann" {
+		t.Errorf("got %s, want every user once, oldest first", got)
+	}
+
+	if w := serve(h, http.MethodGet, "/users?sort=name&cursor=bad", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad cursor: got %d, want 400", w.Code)
+	}
+}
+
+func TestListUsersCursorKeepsFilters(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	for i := 0; i < 6; i++ {
+		createUser(t, h, string(rune('A'+i))+"nn", 20+i)
+	}
+
+	w := serve(h, http.MethodGet, "/users?sort=age&min_age=22&limit=2", "")
+	var page models.UserPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.NextCursor == "" {
+		t.Fatalf("first page: got %s, %v, want a next cursor", w.Body, err)
+	}
+	w = serve(h, http.MethodGet, "/users?sort=age&limit=2&min_age=0022&cursor="+page.NextCursor, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Enn"`) {
+		t.Errorf("same filters written differently: got %d %s, want the second page", w.Code, w.Body)
+	}
+	for _, changed := range []string{"", "&min_age=23", "&min_age=22&max_age=30", "&min_age=22&gender=other", "&min_age=22&name=A", "&min_age=22&include_deleted=true"} {
+		w := serve(h, http.MethodGet, "/users?sort=age&limit=2"+changed+"&cursor="+page.NextCursor, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("filters %q: got %d, want 400", changed, w.Code)
+		}
+	}
+}
+
+func TestDeleteAndRestoreUser(t *testing.T) {
+	h := newTestRouter(time.Hour)
+	u := createUser(t, h, "Ann", 30)
+	path := "/user/" + u.Id.Hex()
+
+	if w := serve(h, http.MethodDelete, path, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d, want 200", w.Code)
+	}
+	if w := serve(h, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after delete: got %d, want 404", w.Code)
+	}
+	w := serve(h, http.MethodGet, path+"?include_deleted=true", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "deleted_at") {
+		t.Errorf("GET with include_deleted: got %d %s, want the user with deleted_at", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodGet, "/users", ""); strings.Contains(w.Body.String(), u.Id.Hex()) {
+		t.Errorf("GET /users lists a deleted user: %s", w.Body)
+	}
+	if w := serve(h, http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: got %d, want 404", w.Code)
+	}
+
+	if w := serve(h, http.MethodPost, path+"/restore", ""); w.Code != http.StatusOK {
+		t.Fatalf("restore: got %d %s, want 200", w.Code, w.Body)
+	}
+	w = serve(h, http.MethodGet, path, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "deleted_at") {
+		t.Errorf("GET after restore: got %d %s, want the user without deleted_at", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodPost, path+"/restore", ""); w.Code != http.StatusOK {
+		t.Errorf("restoring a user that is not deleted: got %d, want 200", w.Code)
+	}
+}
+
+func TestDeletedUserIsPurgedAfterRetention(t *testing.T) {
+	const retention = 50 * time.Millisecond
+	h := newTestRouter(retention)
+	u := createUser(t, h, "Ann", 30)
+	path := "/user/" + u.Id.Hex()
+	if w := serve(h, http.MethodDelete, path, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: got %d, want 200", w.Code)
+	}
+
+	time.Sleep(2 * retention)
+	if w := serve(h, http.MethodGet, path+"?include_deleted=true", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after retention: got %d, want 404", w.Code)
+	}
+	if w := serve(h, http.MethodPost, path+"/restore", ""); w.Code != http.StatusNotFound {
+		t.Errorf("restore after retention: got %d, want 404", w.Code)
+	}
+}
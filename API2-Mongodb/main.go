@@ -2,27 +2,88 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/alaiy95/golang-projects/api2-mongodb/controllers"
+	"github.com/alaiy95/golang-projects/api2-mongodb/repository"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// envString returns the environment variable name, or fallback if it is not set
+func envString(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// envDuration returns the environment variable name parsed as a duration such as "720h", or fallback if it is not set
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s must be a duration such as 720h: %v", name, err)
+	}
+	return d
+}
+
 func main() {
+	// Every flag defaults to an environment variable, so the server can be configured either way
+	store := flag.String("store", envString("USERS_STORE", "mongo"), "where users are kept: mongo, or memory for tests and demos")
+	mongoURI := flag.String("mongo-uri", envString("MONGO_URI", "mongodb://localhost:27017"), "MongoDB connection string")
+	config := repository.Config{}
+	flag.StringVar(&config.Database, "database", envString("MONGO_DATABASE", "mongo-golang"), "MongoDB database")
+	flag.StringVar(&config.Collection, "collection", envString("MONGO_COLLECTION", "users"), "MongoDB collection")
+	flag.DurationVar(&config.Retention, "retention", envDuration("USERS_RETENTION", 30*24*time.Hour), "how long deleted users can be restored before they are purged")
+	addr := flag.String("addr", envString("USERS_ADDR", "localhost:9000"), "address to listen on")
+	flag.Parse()
+	if config.Retention < time.Second || config.Retention > repository.MaxRetention {
+		log.Fatalf("Retention must be between 1s and %v, got %v", repository.MaxRetention, config.Retention)
+	}
+
+	var repo repository.UserRepository
+	switch *store {
+	case "mongo":
+		repo = repository.NewMongoUserRepository(getMongoClient(*mongoURI), config)
+	case "memory":
+		log.Println("Keeping users in memory; they are lost when the server stops")
+		repo = repository.NewMemoryUserRepository(config.Retention)
+	default:
+		log.Fatalf("Unknown store %q, must be mongo or memory", *store)
+	}
+
+	// Install the schema validator and create the indexes GET /users needs before serving any requests
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := repo.Init(ctx); err != nil {
+		log.Fatalf("Failed to prepare the users store: %v", err)
+	}
+	cancel()
+
 	r := httprouter.New()
-	uc := controllers.NewUserController(getMongoClient())
+	uc := controllers.NewUserController(repo)
+	r.GET("/users", uc.ListUsers)
+	r.GET("/users/changes", uc.WatchUsers)
+	r.POST("/users/import", uc.ImportUsers)
 	r.GET("/user/:id", uc.GetUser)
 	r.POST("/user", uc.CreateUser)
+	r.PUT("/user/:id", uc.UpdateUser)
+	r.PATCH("/user/:id", uc.PatchUser)
 	r.DELETE("/user/:id", uc.DeleteUser)
-	http.ListenAndServe("localhost:9000", r)
+	r.POST("/user/:id/restore", uc.RestoreUser)
+	http.ListenAndServe(*addr, r)
 }
 
-func getMongoClient() *mongo.Client {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
+func getMongoClient(uri string) *mongo.Client {
+	clientOptions := options.Client().ApplyURI(uri)
 	client, err := mongo.Connect(context.Background(), clientOptions)
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
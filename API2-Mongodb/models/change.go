@@ -0,0 +1,21 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// The types of UserChange
+const (
+	ChangeCreate  = "create"  // a user was created
+	ChangeUpdate  = "update"  // a user was replaced or patched
+	ChangeDelete  = "delete"  // a user was deleted and can still be restored
+	ChangeRestore = "restore" // a deleted user was restored
+	ChangePurge   = "purge"   // a user was removed for good, usually once its retention period was over
+)
+
+// UserChange is one change to the users. User is the user after the change; it is nil for ChangePurge,
+// and may be nil for other changes if the user was purged before the change was read.
+type UserChange struct {
+	Token string             `json:"-"` // resumes the changes after this one, see repository.UserRepository.Watch
+	Type  string             `json:"type"`
+	ID    primitive.ObjectID `json:"id"`
+	User  *User              `json:"user,omitempty"`
+}
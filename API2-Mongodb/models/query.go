@@ -0,0 +1,159 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserQuery selects a page of users: the filters, the sort order and where the page starts.
+// Every repository answers it the same way (see the repository package).
+type UserQuery struct {
+	Gender         string
+	MinAge         *int
+	MaxAge         *int
+	NamePrefix     string // case-sensitive
+	IncludeDeleted bool   // also select deleted users that are not purged yet
+	SortField      string // id, name, gender or age
+	Desc           bool
+	Limit          int
+	After          *UserCursor
+}
+
+// UserPage is one page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// A UserCursor marks the last user of a page by its sort value and ID, so the next page can start right after it
+// without skipping over the earlier pages. It only applies to the sort order and filters it was made for.
+type UserCursor struct {
+	Sort   string      `json:"s"`
+	Filter string      `json:"f,omitempty"`
+	Value  interface{} `json:"v,omitempty"`
+	ID     string      `json:"id"`
+}
+
+// SortParam returns the sort order as it is written in the sort query parameter, e.g. "-age"
+func (q UserQuery) SortParam() string {
+	if q.Desc {
+		return "-" + q.SortField
+	}
+	return q.SortField
+}
+
+// FilterParam returns the filters as query parameters in a fixed order, e.g. "gender=female&min_age=18",
+// so that the same filters always give the same string however they were written
+func (q UserQuery) FilterParam() string {
+	v := url.Values{}
+	if q.Gender != "" {
+		v.Set("gender", q.Gender)
+	}
+	if q.MinAge != nil {
+		v.Set("min_age", strconv.Itoa(*q.MinAge))
+	}
+	if q.MaxAge != nil {
+		v.Set("max_age", strconv.Itoa(*q.MaxAge))
+	}
+	if q.NamePrefix != "" {
+		v.Set("name", q.NamePrefix)
+	}
+	if q.IncludeDeleted {
+		v.Set("include_deleted", "true")
+	}
+	return v.Encode()
+}
+
+// Matches reports whether a user passes the query's filters. The cursor is not considered.
+func (q UserQuery) Matches(u User) bool {
+	return (q.IncludeDeleted || !u.IsDeleted()) &&
+		(q.Gender == "" || u.Gender == q.Gender) &&
+		(q.MinAge == nil || u.Age >= *q.MinAge) &&
+		(q.MaxAge == nil || u.Age <= *q.MaxAge) &&
+		strings.HasPrefix(u.Name, q.NamePrefix)
+}
+
+// Less orders users by the query's sort field, then by ID
+func (q UserQuery) Less(a, b User) bool {
+	var cmp int
+	switch q.SortField {
+	case "name":
+		cmp = strings.Compare(a.Name, b.Name)
+	case "gender":
+		cmp = strings.Compare(a.Gender, b.Gender)
+	case "age":
+		cmp = a.Age - b.Age
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Id.Hex(), b.Id.Hex())
+	}
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// CursorUser returns the sort value and ID held in the cursor as a user, so it can be compared with Less
+func (q UserQuery) CursorUser() User {
+	u := User{}
+	u.Id, _ = primitive.ObjectIDFromHex(q.After.ID)
+	switch v := q.After.Value.(type) {
+	case string:
+		if q.SortField == "name" {
+			u.Name = v
+		} else {
+			u.Gender = v
+		}
+	case float64:
+		u.Age = int(v)
+	}
+	return u
+}
+
+// Page trims users, fetched with a limit one higher than the query's, to the page size
+// and sets the cursor for the next page if there is one
+func (q UserQuery) Page(users []User) UserPage {
+	page := UserPage{Users: users}
+	if len(users) > q.Limit {
+		page.Users = users[:q.Limit]
+		page.NextCursor = EncodeUserCursor(q, page.Users[q.Limit-1])
+	}
+	return page
+}
+
+// EncodeUserCursor returns the cursor for the page that starts after u
+func EncodeUserCursor(q UserQuery, u User) string {
+	cur := UserCursor{Sort: q.SortParam(), Filter: q.FilterParam(), ID: u.Id.Hex()}
+	switch q.SortField {
+	case "name":
+		cur.Value = u.Name
+	case "gender":
+		cur.Value = u.Gender
+	case "age":
+		cur.Value = u.Age
+	}
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeUserCursor parses a cursor made by EncodeUserCursor
+func DecodeUserCursor(s string) (UserCursor, error) {
+	var cur UserCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return cur, err
+	}
+	if !primitive.IsValidObjectID(cur.ID) {
+		return cur, errors.New("cursor has no valid ID")
+	}
+	return cur, nil
+}
@@ -1,10 +1,36 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User is a document in the users collection. The validate tags are the rules every user must follow;
+// UserJSONSchema gives MongoDB the same rules, so keep the two in step.
+// DeletedAt is set when the user is deleted; the user is hidden from then on and purged once the retention period is over.
 type User struct {
-	Id     primitive.ObjectID `json:"id" bson:"_id"`
-	Name   string             `json:"name" bson:"name"`
-	Gender string             `json:"gender" bson:"gender"`
-	Age    int                `json:"age" bson:"age"`
+	Id        primitive.ObjectID `json:"id" bson:"_id"`
+	Name      string             `json:"name" bson:"name" validate:"required,max=100"`
+	Gender    string             `json:"gender" bson:"gender" validate:"required,oneof=female male other"`
+	Age       int                `json:"age" bson:"age" validate:"min=0,max=150"`
+	DeletedAt *time.Time         `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+}
+
+// IsDeleted reports whether the user has been deleted and is waiting to be purged
+func (u User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
+// UserPatch holds the fields of a PATCH request. Nil fields were not sent and are left unchanged.
+// Fields that are sent follow the same rules as in User (see UserPatch.Validate).
+type UserPatch struct {
+	Name   *string `json:"name" bson:"name,omitempty"`
+	Gender *string `json:"gender" bson:"gender,omitempty"`
+	Age    *int    `json:"age" bson:"age,omitempty"`
+}
+
+// IsEmpty reports whether the patch changes nothing
+func (p UserPatch) IsEmpty() bool {
+	return p.Name == nil && p.Gender == nil && p.Age == nil
 }
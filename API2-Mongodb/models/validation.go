@@ -0,0 +1,120 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FieldError describes one field that breaks the validation rules, by its JSON name
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validate checks structs against their validate tags and reports fields by their JSON names
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	})
+	return v
+}
+
+// Validate trims the user's name and returns the fields that break the rules, or nil if the user is valid
+func (u *User) Validate() []FieldError {
+	u.Name = strings.TrimSpace(u.Name)
+	return fieldErrors(validate.Struct(u))
+}
+
+// Validate trims the patch's name and returns the fields that break the rules, or nil if the patch is valid.
+// Only the fields that were sent are checked, against the rules on User.
+func (p *UserPatch) Validate() []FieldError {
+	u := User{}
+	sent := []string{}
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		p.Name = &name
+		u.Name = name
+		sent = append(sent, "Name")
+	}
+	if p.Gender != nil {
+		u.Gender = *p.Gender
+		sent = append(sent, "Gender")
+	}
+	if p.Age != nil {
+		u.Age = *p.Age
+		sent = append(sent, "Age")
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+	return fieldErrors(validate.StructPartial(u, sent...))
+}
+
+// fieldErrors turns the error returned by the validator into one FieldError per field
+func fieldErrors(err error) []FieldError {
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return nil
+	}
+	errs := make([]FieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		errs = append(errs, FieldError{Field: fe.Field(), Message: fieldMessage(fe)})
+	}
+	return errs
+}
+
+// fieldMessage returns a readable message for a broken rule
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "min", "max":
+		limit := "at least "
+		if fe.Tag() == "max" {
+			limit = "at most "
+		}
+		if fe.Kind() == reflect.String {
+			return "must be " + limit + fe.Param() + " characters"
+		}
+		return "must be " + limit + fe.Param()
+	}
+	return "is invalid"
+}
+
+// UserJSONSchema is the $jsonSchema validator installed on the users collection. It repeats the validate tags on User,
+// so that writes from other tools, such as the mongo shell, are held to the same rules as writes through the API.
+func UserJSONSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"_id", "name", "gender", "age"},
+		"properties": bson.M{
+			"_id": bson.M{"bsonType": "objectId"},
+			"name": bson.M{
+				"bsonType":  "string",
+				"minLength": 1,
+				"maxLength": 100,
+				"pattern":   `\S`,
+			},
+			"gender": bson.M{
+				"bsonType": "string",
+				"enum":     bson.A{"female", "male", "other"},
+			},
+			"age": bson.M{
+				"bsonType": bson.A{"int", "long"},
+				"minimum":  0,
+				"maximum":  150,
+			},
+			// A date, not a string, so the TTL index on it can purge deleted users
+			"deleted_at": bson.M{"bsonType": "date"},
+		},
+	}
+}
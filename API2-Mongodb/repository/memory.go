@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryUserRepository keeps users in a map, for tests and local demos without a MongoDB server.
+// Users are lost when the process exits.
+type MemoryUserRepository struct {
+	mu        sync.RWMutex
+	users     map[primitive.ObjectID]models.User
+	deleted   map[primitive.ObjectID]struct{} // the IDs in users that are deleted, so purge need not look at every user
+	retention time.Duration
+
+	// changes holds the latest changes, oldest first, for Watch. Their tokens count up from 1;
+	// firstSeq is the token of changes[0]. changed is closed and replaced whenever a change is added.
+	changes  []models.UserChange
+	firstSeq int64
+	changed  chan struct{}
+}
+
+// memoryChangeLogSize is how many changes a MemoryUserRepository keeps for streams to resume from
+const memoryChangeLogSize = 1000
+
+// NewMemoryUserRepository returns an empty repository that purges deleted users once retention has passed
+func NewMemoryUserRepository(retention time.Duration) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:     map[primitive.ObjectID]models.User{},
+		deleted:   map[primitive.ObjectID]struct{}{},
+		retention: retention,
+		firstSeq:  1,
+		changed:   make(chan struct{}),
+	}
+}
+
+// record adds a change to u to the change log and wakes up the streams waiting for it. r.mu must be held for writing.
+func (r *MemoryUserRepository) record(changeType string, u models.User) {
+	change := models.UserChange{
+		Token: strconv.FormatInt(r.firstSeq+int64(len(r.changes)), 10),
+		Type:  changeType,
+		ID:    u.Id,
+	}
+	if changeType != models.ChangePurge {
+		change.User = &u
+	}
+	r.changes = append(r.changes, change)
+	if len(r.changes) > memoryChangeLogSize {
+		r.changes = r.changes[1:]
+		r.firstSeq++
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// purge removes the deleted users whose retention period is over. It is the TTL index of MongoUserRepository:
+// every call runs it first, so a user is never seen after it is due to be purged.
+func (r *MemoryUserRepository) purge() {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.deleted {
+		if u := r.users[id]; now.Sub(*u.DeletedAt) >= r.retention {
+			r.record(models.ChangePurge, u)
+			delete(r.users, id)
+			delete(r.deleted, id)
+		}
+	}
+}
+
+// Init rejects a retention the TTL index of MongoUserRepository could not hold, so both repositories accept the same Config
+func (r *MemoryUserRepository) Init(ctx context.Context) error {
+	if r.retention > MaxRetention {
+		return ErrRetentionTooLong
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	r.purge()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[id]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// List filters and sorts every user, then starts the page after the cursor, as MongoUserRepository does with a query
+func (r *MemoryUserRepository) List(ctx context.Context, q models.UserQuery) (models.UserPage, error) {
+	r.purge()
+	r.mu.RLock()
+	matched := []models.User{}
+	for _, u := range r.users {
+		if q.Matches(u) {
+			matched = append(matched, u)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return q.Less(matched[i], matched[j])
+	})
+	start := 0
+	if q.After != nil {
+		last := q.CursorUser()
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.Less(last, matched[i])
+		})
+	}
+	end := start + q.Limit + 1
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return q.Page(matched[start:end]), nil
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, u models.User) error {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[u.Id]; ok {
+		return ErrDuplicateID
+	}
+	r.users[u.Id] = u
+	r.record(models.ChangeCreate, u)
+	return nil
+}
+
+func (r *MemoryUserRepository) CreateMany(ctx context.Context, users []models.User) ([]error, error) {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	errs := make([]error, len(users))
+	for i, u := range users {
+		if _, ok := r.users[u.Id]; ok {
+			errs[i] = ErrDuplicateID
+			continue
+		}
+		r.users[u.Id] = u
+		r.record(models.ChangeCreate, u)
+	}
+	return errs, nil
+}
+
+func (r *MemoryUserRepository) Replace(ctx context.Context, u models.User) error {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.users[u.Id]; !ok || old.IsDeleted() {
+		return ErrNotFound
+	}
+	r.users[u.Id] = u
+	r.record(models.ChangeUpdate, u)
+	return nil
+}
+
+func (r *MemoryUserRepository) Patch(ctx context.Context, id primitive.ObjectID, p models.UserPatch) (models.User, error) {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok || u.IsDeleted() {
+		return models.User{}, ErrNotFound
+	}
+	if p.Name != nil {
+		u.Name = *p.Name
+	}
+	if p.Gender != nil {
+		u.Gender = *p.Gender
+	}
+	if p.Age != nil {
+		u.Age = *p.Age
+	}
+	if !p.IsEmpty() {
+		r.users[id] = u
+		r.record(models.ChangeUpdate, u)
+	}
+	return u, nil
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok || u.IsDeleted() {
+		return ErrNotFound
+	}
+	u.DeletedAt = deletionTime()
+	r.users[id] = u
+	r.deleted[id] = struct{}{}
+	r.record(models.ChangeDelete, u)
+	return nil
+}
+
+func (r *MemoryUserRepository) Restore(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	r.purge()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	if u.IsDeleted() {
+		u.DeletedAt = nil
+		r.users[id] = u
+		delete(r.deleted, id)
+		r.record(models.ChangeRestore, u)
+	}
+	return u, nil
+}
+
+// Watch follows the change log. Tokens are sequence numbers, and a stream can be resumed as long as the change
+// is among the last memoryChangeLogSize.
+func (r *MemoryUserRepository) Watch(ctx context.Context, after string) (ChangeStream, error) {
+	r.purge()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	next := r.firstSeq + int64(len(r.changes))
+	if after != "" {
+		seq, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || seq < r.firstSeq-1 || seq >= next {
+			return nil, ErrUnknownResumeToken
+		}
+		next = seq + 1
+	}
+	return &memoryChangeStream{r: r, next: next}, nil
+}
+
+type memoryChangeStream struct {
+	r    *MemoryUserRepository
+	next int64 // the token of the change Next returns
+}
+
+func (s *memoryChangeStream) Next(ctx context.Context) (models.UserChange, error) {
+	for {
+		s.r.mu.RLock()
+		if s.next < s.r.firstSeq {
+			// The stream fell so far behind that the change it needs has left the log
+			s.r.mu.RUnlock()
+			return models.UserChange{}, ErrUnknownResumeToken
+		}
+		if i := s.next - s.r.firstSeq; i < int64(len(s.r.changes)) {
+			change := s.r.changes[i]
+			s.r.mu.RUnlock()
+			s.next++
+			return change, nil
+		}
+		changed := s.r.changed
+		s.r.mu.RUnlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return models.UserChange{}, ctx.Err()
+		}
+	}
+}
+
+func (s *memoryChangeStream) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInitRejectsRetentionOverTTLLimit(t *testing.T) {
+	if err := NewMemoryUserRepository(MaxRetention).Init(context.Background()); err != nil {
+		t.Errorf("MaxRetention: got %v, want nil", err)
+	}
+	if err := NewMemoryUserRepository(MaxRetention + time.Second).Init(context.Background()); !errors.Is(err, ErrRetentionTooLong) {
+		t.Errorf("over MaxRetention: got %v, want ErrRetentionTooLong", err)
+	}
+}
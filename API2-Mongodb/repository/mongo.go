@@ -0,0 +1,390 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoUserRepository keeps users in a MongoDB collection
+type MongoUserRepository struct {
+	db         *mongo.Database
+	collection *mongo.Collection
+	retention  time.Duration
+}
+
+// NewMongoUserRepository returns a repository over the database and collection named in the config
+func NewMongoUserRepository(client *mongo.Client, config Config) *MongoUserRepository {
+	db := client.Database(config.Database)
+	return &MongoUserRepository{db: db, collection: db.Collection(config.Collection), retention: config.Retention}
+}
+
+// notDeleted matches the users that are not deleted
+var notDeleted = bson.M{"$exists": false}
+
+// MongoDB error codes the repository handles
+const (
+	indexOptionsConflict    = 85    // an index exists with other options
+	duplicateKey            = 11000 // a document with the same _id already exists
+	invalidResumeToken      = 260   // a change stream resume token could not be read
+	changeStreamFatalError  = 280   // a change stream could not be resumed from its token
+	changeStreamHistoryLost = 286   // the changes after a resume token have left the oplog
+)
+
+// userIndexes are the indexes List relies on. Each sortable field is indexed together with _id,
+// which is the tie-breaker of every sort and the second key of every cursor.
+var userIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+	{Keys: bson.D{{Key: "gender", Value: 1}, {Key: "_id", Value: 1}}},
+	{Keys: bson.D{{Key: "age", Value: 1}, {Key: "_id", Value: 1}}},
+	{Keys: bson.D{{Key: "gender", Value: 1}, {Key: "age", Value: 1}, {Key: "_id", Value: 1}}},
+}
+
+// Init installs models.UserJSONSchema as the validator of the collection, creating the collection if needed,
+// so MongoDB rejects invalid users whichever tool writes them. It then creates the indexes List needs,
+// and a TTL index on deleted_at with which MongoDB purges deleted users once the retention period has passed.
+func (r *MongoUserRepository) Init(ctx context.Context) error {
+	validator := bson.M{"$jsonSchema": models.UserJSONSchema()}
+	err := r.db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: r.collection.Name()},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "strict"},
+		{Key: "validationAction", Value: "error"},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceNotFound" {
+		err = r.db.CreateCollection(ctx, r.collection.Name(), options.CreateCollection().SetValidator(validator))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = r.collection.Indexes().CreateMany(ctx, userIndexes); err != nil {
+		return err
+	}
+	return r.ensureTTLIndex(ctx)
+}
+
+// ensureTTLIndex creates the TTL index on deleted_at, or changes its expiry if the retention period was changed since it was created
+func (r *MongoUserRepository) ensureTTLIndex(ctx context.Context) error {
+	if r.retention > MaxRetention {
+		return ErrRetentionTooLong
+	}
+	keys := bson.D{{Key: "deleted_at", Value: 1}}
+	expireAfter := int32(r.retention / time.Second)
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetExpireAfterSeconds(expireAfter),
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == indexOptionsConflict {
+		err = r.db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: r.collection.Name()},
+			{Key: "index", Value: bson.M{"keyPattern": keys, "expireAfterSeconds": expireAfter}},
+		}).Err()
+	}
+	return err
+}
+
+func (r *MongoUserRepository) Get(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	u := models.User{}
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+func (r *MongoUserRepository) List(ctx context.Context, q models.UserQuery) (models.UserPage, error) {
+	filter, err := queryFilter(q)
+	if err != nil {
+		return models.UserPage{}, err
+	}
+	cursor, err := r.collection.Find(ctx, filter, findOptions(q))
+	if err != nil {
+		return models.UserPage{}, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return models.UserPage{}, err
+	}
+	return q.Page(users), nil
+}
+
+func (r *MongoUserRepository) Create(ctx context.Context, u models.User) error {
+	_, err := r.collection.InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateID
+	}
+	return err
+}
+
+// CreateMany inserts the users with an unordered InsertMany, so MongoDB carries on past a user it rejects
+func (r *MongoUserRepository) CreateMany(ctx context.Context, users []models.User) ([]error, error) {
+	docs := make([]interface{}, len(users))
+	for i, u := range users {
+		docs[i] = u
+	}
+	errs := make([]error, len(users))
+	_, err := r.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			errs[writeErr.Index] = writeErr
+			if writeErr.Code == duplicateKey {
+				errs[writeErr.Index] = ErrDuplicateID
+			}
+		}
+		return errs, nil
+	}
+	return errs, err
+}
+
+func (r *MongoUserRepository) Replace(ctx context.Context, u models.User) error {
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": u.Id, "deleted_at": notDeleted}, u)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Patch leaves nil fields out of $set. An empty patch just returns the user.
+func (r *MongoUserRepository) Patch(ctx context.Context, id primitive.ObjectID, p models.UserPatch) (models.User, error) {
+	if p.IsEmpty() {
+		u, err := r.Get(ctx, id)
+		if err == nil && u.IsDeleted() {
+			return models.User{}, ErrNotFound
+		}
+		return u, err
+	}
+	return r.findAndUpdate(ctx, bson.M{"_id": id, "deleted_at": notDeleted}, bson.M{"$set": p})
+}
+
+func (r *MongoUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	filter := bson.M{"_id": id, "deleted_at": notDeleted}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"deleted_at": deletionTime()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *MongoUserRepository) Restore(ctx context.Context, id primitive.ObjectID) (models.User, error) {
+	return r.findAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+}
+
+// findAndUpdate applies update to the user matching filter and returns the updated user, or ErrNotFound
+func (r *MongoUserRepository) findAndUpdate(ctx context.Context, filter, update bson.M) (models.User, error) {
+	u := models.User{}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+// documentField maps a sort field of models.UserQuery to the document field it sorts on
+func documentField(sortField string) string {
+	if sortField == "id" {
+		return "_id"
+	}
+	return sortField
+}
+
+// queryFilter returns the MongoDB filter for the query's filters and cursor
+func queryFilter(q models.UserQuery) (bson.M, error) {
+	filter := bson.M{}
+	if !q.IncludeDeleted {
+		filter["deleted_at"] = notDeleted
+	}
+	if q.Gender != "" {
+		filter["gender"] = q.Gender
+	}
+	age := bson.M{}
+	if q.MinAge != nil {
+		age["$gte"] = *q.MinAge
+	}
+	if q.MaxAge != nil {
+		age["$lte"] = *q.MaxAge
+	}
+	if len(age) > 0 {
+		filter["age"] = age
+	}
+	if q.NamePrefix != "" {
+		// An anchored, case-sensitive regular expression is answered from the name index
+		filter["name"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.NamePrefix)}
+	}
+	if q.After == nil {
+		return filter, nil
+	}
+
+	// Users after the cursor have a later sort value, or the same sort value and a later ID
+	oid, err := primitive.ObjectIDFromHex(q.After.ID)
+	if err != nil {
+		return nil, err
+	}
+	op := "$gt"
+	if q.Desc {
+		op = "$lt"
+	}
+	var after bson.M
+	if field := documentField(q.SortField); field == "_id" {
+		after = bson.M{"_id": bson.M{op: oid}}
+	} else {
+		value := q.After.Value
+		if f, ok := value.(float64); ok {
+			// Ages come back from JSON as float64 but are stored as integers
+			value = int(f)
+		}
+		after = bson.M{"$or": bson.A{
+			bson.M{field: bson.M{op: value}},
+			bson.M{field: value, "_id": bson.M{op: oid}},
+		}}
+	}
+	if len(filter) == 0 {
+		return after, nil
+	}
+	return bson.M{"$and": bson.A{filter, after}}, nil
+}
+
+// findOptions returns the sort order and limit for the query. One extra user is fetched to tell whether there is a next page.
+func findOptions(q models.UserQuery) *options.FindOptions {
+	dir := 1
+	if q.Desc {
+		dir = -1
+	}
+	field := documentField(q.SortField)
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+	return options.Find().SetSort(sort).SetLimit(int64(q.Limit) + 1)
+}
+
+// Watch opens a MongoDB change stream on the collection. Change streams need a replica set or a sharded cluster;
+// a single mongod can be started as a one-member replica set. Tokens are the change stream's resume tokens,
+// base64url-encoded as they are, so a stream can be resumed as long as the change is still in the oplog.
+func (r *MongoUserRepository) Watch(ctx context.Context, after string) (ChangeStream, error) {
+	var resumeAfter bson.Raw
+	if after != "" {
+		token, err := decodeResumeToken(after)
+		if err != nil {
+			return nil, err
+		}
+		resumeAfter = token
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "replace", "update", "delete"}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	cs, err := r.collection.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, changeStreamError(err)
+	}
+	return mongoChangeStream{cs}, nil
+}
+
+// changeStreamError turns the errors MongoDB gives for a resume token it cannot resume from into ErrUnknownResumeToken
+func changeStreamError(err error) error {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		switch cmdErr.Code {
+		case invalidResumeToken, changeStreamFatalError, changeStreamHistoryLost:
+			return ErrUnknownResumeToken
+		}
+	}
+	return err
+}
+
+// encodeResumeToken turns a change stream resume token into a Token. The token's fields are up to the server,
+// so the whole document is kept rather than any one field of it.
+func encodeResumeToken(token bson.Raw) string {
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// decodeResumeToken undoes encodeResumeToken, returning ErrUnknownResumeToken if s is not a token it made
+func decodeResumeToken(s string) (bson.Raw, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrUnknownResumeToken
+	}
+	token := bson.Raw(b)
+	if err := token.Validate(); err != nil {
+		return nil, ErrUnknownResumeToken
+	}
+	return token, nil
+}
+
+type mongoChangeStream struct {
+	cs *mongo.ChangeStream
+}
+
+// mongoChangeEvent holds the fields of a change event that UserChange is made from
+type mongoChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *models.User `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+func (s mongoChangeStream) Next(ctx context.Context) (models.UserChange, error) {
+	if !s.cs.Next(ctx) {
+		if err := s.cs.Err(); err != nil {
+			return models.UserChange{}, changeStreamError(err)
+		}
+		return models.UserChange{}, ctx.Err()
+	}
+	var event mongoChangeEvent
+	if err := s.cs.Decode(&event); err != nil {
+		return models.UserChange{}, err
+	}
+	change := models.UserChange{
+		Token: encodeResumeToken(s.cs.ResumeToken()),
+		ID:    event.DocumentKey.ID,
+		User:  event.FullDocument,
+	}
+	switch event.OperationType {
+	case "insert":
+		change.Type = models.ChangeCreate
+	case "delete":
+		change.Type = models.ChangePurge
+	default:
+		// Deleting and restoring are updates of deleted_at
+		change.Type = models.ChangeUpdate
+		if _, ok := event.UpdateDescription.UpdatedFields["deleted_at"]; ok {
+			change.Type = models.ChangeDelete
+		}
+		for _, field := range event.UpdateDescription.RemovedFields {
+			if field == "deleted_at" {
+				change.Type = models.ChangeRestore
+			}
+		}
+	}
+	return change, nil
+}
+
+func (s mongoChangeStream) Close(ctx context.Context) error {
+	return s.cs.Close(ctx)
+}
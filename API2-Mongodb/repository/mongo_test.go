@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	token, err := bson.Marshal(bson.M{"_data": "8263F0A1B2000000012B022C0100296E5A1004"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := encodeResumeToken(token)
+	got, err := decodeResumeToken(s)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	if !bytes.Equal(got, token) {
+		t.Errorf("got %v, want %v", got, bson.Raw(token))
+	}
+}
+
+func TestDecodeResumeTokenRejectsBadTokens(t *testing.T) {
+	for _, s := range []string{"not base64!", "AAAA", "12345"} {
+		if _, err := decodeResumeToken(s); !errors.Is(err, ErrUnknownResumeToken) {
+			t.Errorf("%q: got %v, want ErrUnknownResumeToken", s, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package repository stores users. The controllers only see the UserRepository interface, so the same handlers
+// run against MongoDB or, for tests and local demos, against memory.
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/alaiy95/golang-projects/api2-mongodb/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned when no user has the requested ID
+var ErrNotFound = errors.New("user not found")
+
+// ErrDuplicateID is returned by Create, and in the errors of CreateMany, when a user with the same ID already exists
+var ErrDuplicateID = errors.New("a user with this ID already exists")
+
+// ErrUnknownResumeToken is returned by Watch, and by ChangeStream.Next, when the changes after a resume token
+// are no longer kept, or the token was never issued
+var ErrUnknownResumeToken = errors.New("resume token is unknown or too old")
+
+// UserRepository is the storage of users
+type UserRepository interface {
+	// Init prepares the storage, e.g. installs schema validation and indexes. It is called once at startup.
+	Init(ctx context.Context) error
+	// Get returns the user with the given ID, deleted or not, or ErrNotFound once it is purged
+	Get(ctx context.Context, id primitive.ObjectID) (models.User, error)
+	// List returns one page of the users matching the query, in the query's order
+	List(ctx context.Context, q models.UserQuery) (models.UserPage, error)
+	// Create adds a new user, whose ID is already set
+	Create(ctx context.Context, u models.User) error
+	// CreateMany adds new users, whose IDs are already set, in one batch. A user that cannot be added does not stop the others:
+	// errs holds, for each user, nil if it was added or the reason it was not. err is set if the batch failed as a whole,
+	// in which case it is unknown which users were added.
+	CreateMany(ctx context.Context, users []models.User) (errs []error, err error)
+	// Replace overwrites the user with the same ID, or returns ErrNotFound if there is no such user or it is deleted
+	Replace(ctx context.Context, u models.User) error
+	// Patch sets the fields of the patch that are not nil and returns the updated user,
+	// or ErrNotFound if there is no such user or it is deleted
+	Patch(ctx context.Context, id primitive.ObjectID, p models.UserPatch) (models.User, error)
+	// Delete sets DeletedAt on the user with the given ID, or returns ErrNotFound if there is no such user or it is already deleted.
+	// The user is purged once the retention period has passed, unless it is restored first.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Restore clears DeletedAt on the user with the given ID and returns it, or ErrNotFound once it is purged.
+	// Restoring a user that is not deleted changes nothing.
+	Restore(ctx context.Context, id primitive.ObjectID) (models.User, error)
+	// Watch returns the changes made after the change whose Token is after, or from now on if after is empty.
+	// The stream ends when ctx is done.
+	Watch(ctx context.Context, after string) (ChangeStream, error)
+}
+
+// A ChangeStream delivers the changes to users in the order they were made
+type ChangeStream interface {
+	// Next waits for the next change
+	Next(ctx context.Context) (models.UserChange, error)
+	Close(ctx context.Context) error
+}
+
+// Config names where MongoDB keeps the users and says how long deleted users are kept
+type Config struct {
+	Database   string
+	Collection string
+	Retention  time.Duration
+}
+
+// MaxRetention is the longest Retention there can be. MongoDB keeps a TTL index's expiry as a 32-bit number of seconds,
+// so anything longer, about 68 years, would wrap around.
+const MaxRetention = math.MaxInt32 * time.Second
+
+// ErrRetentionTooLong is returned by Init when Retention is over MaxRetention
+var ErrRetentionTooLong = errors.New("retention is longer than " + MaxRetention.String())
+
+// deletionTime returns the time to set as DeletedAt. It is rounded to the millisecond, as MongoDB stores dates,
+// so both repositories return the same value.
+func deletionTime() *time.Time {
+	t := time.Now().UTC().Truncate(time.Millisecond)
+	return &t
+}